@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/igredk/greenlight/internal/data"
+	"github.com/igredk/greenlight/internal/jwt"
+	"github.com/igredk/greenlight/internal/validator"
+)
+
+// Issuer of the access tokens, which is checked when verifying them.
+const accessTokenIssuer = "greenlight"
+
+// The claims of an access token. They carry the permissions requirePermission() needs,
+// so that the only database lookup for a request made with an access token is the
+// user's status, which is cached. The flip side is that changes to a user's permissions
+// only take effect once the access token has been refreshed.
+type accessClaims struct {
+	jwt.Claims
+	Permissions data.Permissions `json:"permissions"`
+	// The family of the refresh token issued along with the access token, which
+	// identifies the session.
+	Session string `json:"sid"`
+}
+
+// Issue an access token together with a refresh token to a user who has logged in, or
+// who has exchanged the previous refresh token of an existing session.
+func (app *application) sendAccessToken(w http.ResponseWriter, r *http.Request, user *data.User, previous *data.Token) {
+	refreshToken, err := app.models.Tokens.NewRefresh(r.Context(), user.ID, app.config.auth.refreshTTL, app.client(r), previous)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	now := time.Now()
+	accessToken := &data.Token{Expiry: now.Add(app.config.auth.accessTTL)}
+
+	claims := accessClaims{
+		Claims: jwt.Claims{
+			Issuer:    accessTokenIssuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: accessToken.Expiry.Unix(),
+		},
+		Permissions: permissions,
+		Session:     refreshToken.Family,
+	}
+
+	accessToken.Plaintext, err = jwt.Sign(claims, []byte(app.config.auth.jwtSecret))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"access_token": accessToken, "refresh_token": refreshToken}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a refresh token for a new access token and refresh token. Every refresh token
+// can only be used once, so if one is used again it must have been stolen, either by
+// whoever used it first or by whoever is using it now. As there's no telling which, the
+// whole session is revoked.
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.UseRefresh(r.Context(), input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			err = app.models.Tokens.DeleteFamily(r.Context(), token.Family)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			app.audit(r, token.UserID, data.AuditRefreshTokenReused, map[string]any{"session": token.Family})
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Suspended {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	app.sendAccessToken(w, r, user, token)
+}
+
+// Verify an access token, returning its claims.
+func (app *application) parseAccessToken(token string) (*accessClaims, error) {
+	if app.config.auth.jwtSecret == "" {
+		return nil, jwt.ErrInvalidToken
+	}
+
+	var claims accessClaims
+	err := jwt.Parse(token, []byte(app.config.auth.jwtSecret), &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	err = claims.Validate(accessTokenIssuer, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
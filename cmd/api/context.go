@@ -14,6 +14,15 @@ type contextKey string
 // constant. We'll use this constant as the key for getting and setting user information in the request context.
 const userContextKey = contextKey("user")
 
+// Key for the plaintext authentication token that the current request was authenticated with.
+const tokenContextKey = contextKey("token")
+
+// Key for the API key that the current request was authenticated with.
+const apiKeyContextKey = contextKey("apiKey")
+
+// Key for the claims of the access token that the current request was authenticated with.
+const accessClaimsContextKey = contextKey("accessClaims")
+
 // The contextSetUser() method returns a new copy of the request with the provided User struct added to the context.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -32,3 +41,49 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token added to the context.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() retrieves the plaintext authentication token from the request context.
+// It is only set for requests carrying a valid bearer token, so it panics otherwise.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, ok := r.Context().Value(tokenContextKey).(string)
+	if !ok {
+		panic("missing token value in request context")
+	}
+
+	return token
+}
+
+// The contextSetAPIKey() method returns a new copy of the request with the API key that it
+// was authenticated with added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() retrieves the API key from the request context. Unlike the other
+// helpers it doesn't panic, but returns nil if the request wasn't made with an API key.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// The contextSetAccessClaims() method returns a new copy of the request with the claims
+// of the access token that it was authenticated with added to the context.
+func (app *application) contextSetAccessClaims(r *http.Request, claims *accessClaims) *http.Request {
+	ctx := context.WithValue(r.Context(), accessClaimsContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAccessClaims() retrieves the access token claims from the request context,
+// or nil if the request wasn't made with an access token.
+func (app *application) contextGetAccessClaims(r *http.Request) *accessClaims {
+	claims, _ := r.Context().Value(accessClaimsContextKey).(*accessClaims)
+	return claims
+}
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/igredk/greenlight/internal/data"
 )
 
+// Non-standard status code (popularized by nginx) for requests which the client closed
+// before the server could respond.
+const statusClientClosedRequest = 499
+
 func (app *application) logError(r *http.Request, err error) {
 	var (
 		method = r.Method
@@ -14,10 +25,19 @@ func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{"request_method": method, "request_url": uri})
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	env := envelope{"error": message}
+// The code parameter is one of the errCode constants. It identifies the kind of error in
+// problem+json responses, while the default format only contains the message.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message any) {
+	// The response format depends on the Accept header, so warn any caches about it.
+	w.Header().Add("Vary", "Accept")
+
+	var err error
 
-	err := app.writeJSON(w, status, env, nil)
+	if app.wantsProblemJSON(r) {
+		err = app.writeProblem(w, r, status, code, message)
+	} else {
+		err = app.writeJSON(w, status, envelope{"error": message}, nil)
+	}
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -26,63 +46,123 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, errCodeRateLimitExceeded, message)
 }
 
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	// Queries that were aborted because the request context was canceled or timed out
+	// aren't server errors, so we report them with a more fitting status code instead.
+	switch {
+	case errors.Is(err, data.ErrQueryCanceled):
+		if errors.Is(context.Cause(r.Context()), errServerShutdown) {
+			app.serviceUnavailableResponse(w, r)
+		} else {
+			app.clientClosedRequestResponse(w, r)
+		}
+		return
+	case errors.Is(err, data.ErrQueryTimeout):
+		app.serviceUnavailableResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, errCodeServerError, message)
+}
+
+// The client has most likely gone away already, but we still write a response so that
+// the status code shows up correctly in the logs and metrics.
+func (app *application) clientClosedRequestResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the request was canceled by the client"
+	app.errorResponse(w, r, statusClientClosedRequest, errCodeClientClosedRequest, message)
+}
+
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server is temporarily unable to handle your request, please try again later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, errCodeServiceUnavailable, message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, errCodeNotFound, message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	app.errorResponse(w, r, http.StatusBadRequest, errCodeBadRequest, err.Error())
 }
 
 // Errors parameter has the type map[string]string, which is the same as the errors map in Validator type.
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errCodeValidationFailed, errors)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, errCodeEditConflict, message)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeInvalidCredentials, message)
+}
+
+// Sent while logins with an email address are locked after too many failed attempts.
+func (app *application) accountLockedResponse(w http.ResponseWriter, r *http.Request, until time.Time) {
+	retryAfter := max(int(math.Ceil(time.Until(until).Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	message := "too many failed login attempts, please try again later or follow the instructions sent to the account's email address to unlock it"
+	app.errorResponse(w, r, http.StatusTooManyRequests, errCodeAccountLocked, message)
+}
+
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	app.errorResponse(w, r, http.StatusForbidden, errCodeAccountSuspended, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeInvalidAuthenticationToken, message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, errCodeAuthenticationRequired, message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, errCodeInactiveAccount, message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, errCodeNotPermitted, message)
+}
+
+func (app *application) apiKeyNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key, please use an authentication token instead"
+	app.errorResponse(w, r, http.StatusForbidden, errCodeAPIKeyNotAllowed, message)
+}
+
+func (app *application) emailNotVerifiedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the identity provider hasn't verified the email address of your account"
+	app.errorResponse(w, r, http.StatusForbidden, errCodeEmailNotVerified, message)
+}
+
+// Sent when the OpenID Connect provider can't be reached or sends an invalid response. The
+// error is logged, since it is most likely a misconfiguration or an outage of the provider.
+func (app *application) identityProviderErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.logError(r, err)
+
+	message := "the identity provider couldn't be reached or sent an invalid response, please try again later"
+	app.errorResponse(w, r, http.StatusBadGateway, errCodeIdentityProviderError, message)
 }
@@ -9,17 +9,17 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
+	"github.com/igredk/greenlight/internal/data"
 	"github.com/igredk/greenlight/internal/validator"
-	"github.com/julienschmidt/httprouter"
+	"github.com/tomasen/realip"
 )
 
-// Retrieve the "id" URL parameter from the current request context, then convert it to
+// Retrieve the "id" URL parameter from the current request, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
-	params := httprouter.ParamsFromContext(r.Context())
-
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
 	if err != nil || id < 1 {
 		return 0, errors.New("invalid id parameter")
 	}
@@ -27,6 +27,11 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// Retrieve a string URL parameter with the given name from the current request.
+func (app *application) readStringParam(r *http.Request, name string) string {
+	return r.PathValue(name)
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	// Use http.MaxBytesReader() to limit the size of the request body to 1MB.
 	maxBytes := 1_048_576
@@ -162,21 +167,66 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// The background() helper accepts an arbitrary function as a parameter.
-func (app *application) background(fn func()) {
-	// Increment the WaitGroup counter.
-	app.wg.Add(1)
-	// Launch a background goroutine.
-	go func() {
-		// Decrement the WaitGroup counter before the goroutine returns.
-		defer app.wg.Done()
-		// Recover any panic.
-		defer func() {
-			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
-			}
-		}()
-		// Execute the arbitrary function.
-		fn()
-	}()
+// Reads a boolean value ("true" or "false") from the query string. It returns nil if no
+// matching key could be found, and records an error in the provided Validator instance
+// if the value isn't a boolean.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// Record an action taken by the authenticated user in the audit log. The action has
+// already happened at this point, so failures are only logged rather than failing the
+// request.
+func (app *application) audit(r *http.Request, userID int64, action string, details map[string]any) {
+	entry := &data.AuditEntry{
+		UserID:  userID,
+		Action:  action,
+		Details: details,
+	}
+
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		entry.ActorID = user.ID
+	}
+
+	err := app.models.Audit.Insert(r.Context(), entry)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"audit_action": action})
+	}
+}
+
+// Describe the client making the request, to be stored with the session it starts. Both
+// values come from headers which the client is free to fill with anything, so invalid
+// UTF-8, which PostgreSQL won't store as text, is replaced, and overly long values are cut
+// short, as they're only shown to the user.
+func (app *application) client(r *http.Request) data.Client {
+	return data.Client{
+		IP:        headerText(realip.FromRequest(r), 64),
+		UserAgent: headerText(r.UserAgent(), 256),
+	}
+}
+
+// Turn a header value into valid UTF-8 of at most maxLen bytes, cutting it short at the
+// start of a character.
+func headerText(value string, maxLen int) string {
+	value = strings.ToValidUTF8(value, "\uFFFD")
+	if len(value) <= maxLen {
+		return value
+	}
+
+	for maxLen > 0 && !utf8.RuneStart(value[maxLen]) {
+		maxLen--
+	}
+
+	return value[:maxLen]
 }
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"runtime"
 	"strconv"
@@ -15,6 +17,7 @@ import (
 	"github.com/igredk/greenlight/internal/data"
 	"github.com/igredk/greenlight/internal/jsonlog"
 	"github.com/igredk/greenlight/internal/mailer"
+	"github.com/igredk/greenlight/internal/oidc"
 	"github.com/igredk/greenlight/internal/vcs"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -24,18 +27,32 @@ var (
 )
 
 type config struct {
-	port int
-	env  string
-	db   struct {
+	port  int
+	env   string
+	store string
+	db    struct {
 		dsn          string
 		maxOpenConns int
 		maxIdleTime  string
+		automigrate  bool
+	}
+	permissionCache struct {
+		size int
+		ttl  time.Duration
+	}
+	statusCache struct {
+		size int
+		ttl  time.Duration
 	}
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
 	}
+	mailer struct {
+		transport string
+		dir       string
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -43,9 +60,38 @@ type config struct {
 		password string
 		sender   string
 	}
+	passwords struct {
+		data.PasswordParams
+		minStrength  int
+		rejectCommon bool
+		breachedFile string
+	}
+	auth struct {
+		mode         string
+		jwtSecret    string
+		accessTTL    time.Duration
+		refreshTTL   time.Duration
+		magicLinkURL string
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+	}
+	lockout struct {
+		threshold   int
+		window      time.Duration
+		maxDuration time.Duration
+	}
+	outbox struct {
+		workers     int
+		maxAttempts int
+	}
 	cors struct {
 		trustedOrigins []string
 	}
+	errorFormat string
 }
 
 type application struct {
@@ -53,34 +99,93 @@ type application struct {
 	logger *jsonlog.Logger
 	models data.Models
 	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	// The OpenID Connect provider to log in with, or nil if it isn't configured.
+	oidc *oidc.Provider
+	wg   sync.WaitGroup
+	// Signals the outbox workers that an email has been enqueued.
+	outboxWake chan struct{}
 }
 
 func main() {
 	var cfg config
+	cfg.passwords.PasswordParams = data.DefaultPasswordParams
 	// HTTP server
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	// Data store
+	flag.StringVar(&cfg.store, "store", "postgres", "Data store (postgres|memory)")
 	// Database
 	flag.StringVar(&cfg.db.dsn, "pg-dsn", "", "PostgreSQL connection URL")
 	flag.IntVar(&cfg.db.maxOpenConns, "pg-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "pg-max-idle-time", "15m", "PostgreSQL max connection idle time")
+	flag.BoolVar(&cfg.db.automigrate, "db-automigrate", false, "Apply pending database migrations on startup")
+	// Permission cache
+	flag.IntVar(&cfg.permissionCache.size, "permission-cache-size", 10000, "Maximum number of users to cache permissions for (0 disables the cache)")
+	flag.DurationVar(&cfg.permissionCache.ttl, "permission-cache-ttl", time.Minute, "Time to cache the permissions of a user for")
+	flag.IntVar(&cfg.statusCache.size, "status-cache-size", 10000, "Maximum number of users to cache the activation and suspension status of (0 disables the cache)")
+	flag.DurationVar(&cfg.statusCache.ttl, "status-cache-ttl", time.Minute, "Time to cache the status of a user for")
 	// Rate limiter
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	// Mailer
+	flag.StringVar(&cfg.mailer.transport, "mailer", "", "Mailer transport (smtp|file|log) (default log in development, smtp otherwise)")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "./tmp/mail", "Directory to write .eml files to with the file mailer")
 	// SMTP server
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "localhost", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "dc1a969cd7920e", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "68935db316fb19", "SMTP password")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.com>", "SMTP sender")
+	// Password hashing
+	flag.StringVar(&cfg.passwords.Algorithm, "password-hash", data.DefaultPasswordParams.Algorithm, "Algorithm to hash new passwords with (argon2id|bcrypt)")
+	flag.IntVar(&cfg.passwords.BcryptCost, "bcrypt-cost", data.DefaultPasswordParams.BcryptCost, "bcrypt cost")
+	flag.Func("argon2-memory", "argon2id memory in KiB (default 19456)", func(val string) error {
+		n, err := strconv.ParseUint(val, 10, 32)
+		cfg.passwords.Argon2Memory = uint32(n)
+		return err
+	})
+	flag.Func("argon2-iterations", "argon2id number of passes (default 2)", func(val string) error {
+		n, err := strconv.ParseUint(val, 10, 32)
+		cfg.passwords.Argon2Iterations = uint32(n)
+		return err
+	})
+	flag.Func("argon2-parallelism", "argon2id degree of parallelism (default 1)", func(val string) error {
+		n, err := strconv.ParseUint(val, 10, 8)
+		cfg.passwords.Argon2Parallelism = uint8(n)
+		return err
+	})
+	// Password policy
+	flag.IntVar(&cfg.passwords.minStrength, "password-min-strength", data.DefaultPasswordPolicy.MinStrength, "Minimum strength score of new passwords (0-4)")
+	flag.BoolVar(&cfg.passwords.rejectCommon, "password-reject-common", data.DefaultPasswordPolicy.RejectCommon, "Reject common passwords")
+	flag.StringVar(&cfg.passwords.breachedFile, "password-breached-file", "", "Breached passwords to reject, as a directory of Pwned Passwords hash prefix files or a file of SHA-1 hashes sorted by hash")
+	// Authentication
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "token", "Tokens issued on login (token|jwt)")
+	flag.StringVar(&cfg.auth.jwtSecret, "jwt-secret", "", "Secret key to sign access tokens with (at least 32 bytes)")
+	flag.DurationVar(&cfg.auth.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of access tokens")
+	flag.DurationVar(&cfg.auth.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&cfg.auth.magicLinkURL, "magic-link-url", "http://localhost:3000/login/magic-link", "Frontend URL that magic links point to, with the login token added in the token query parameter")
+	// OpenID Connect login
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "Issuer URL of the OpenID Connect provider (empty disables OIDC login)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "URL the provider redirects to after login, registered with the provider")
+	// Account lockout
+	flag.IntVar(&cfg.lockout.threshold, "lockout-threshold", 5, "Consecutive failed logins after which an account is locked")
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", 24*time.Hour, "Time after the last failed login after which failures are counted from scratch")
+	flag.DurationVar(&cfg.lockout.maxDuration, "lockout-max-duration", time.Hour, "Maximum time an account is locked for")
+	// Email outbox
+	flag.IntVar(&cfg.outbox.workers, "outbox-workers", 2, "Number of workers sending emails from the outbox")
+	flag.IntVar(&cfg.outbox.maxAttempts, "outbox-max-attempts", 8, "Maximum number of attempts to send an email")
 	// CORS
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
 
+	// Error responses
+	flag.StringVar(&cfg.errorFormat, "error-format", "json", "Default format of error responses (json|problem)")
+
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
 	flag.Parse()
@@ -93,26 +198,224 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	dbPool, err := openDB(cfg)
+	if cfg.errorFormat != "json" && cfg.errorFormat != "problem" {
+		logger.PrintFatal(fmt.Errorf("unknown error format %q", cfg.errorFormat), nil)
+	}
+
+	err := data.SetPasswordParams(cfg.passwords.PasswordParams)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	policy := data.PasswordPolicy{
+		MinStrength:  cfg.passwords.minStrength,
+		RejectCommon: cfg.passwords.rejectCommon,
+	}
+	if cfg.passwords.breachedFile != "" {
+		policy.Breached, err = data.OpenBreachedPasswords(cfg.passwords.breachedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+	err = data.SetPasswordPolicy(policy)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
-	defer dbPool.Close()
-	logger.PrintInfo(
-		"database connection established",
-		map[string]string{
-			"max_conns":      strconv.Itoa(int((dbPool.Config().MaxConns))),
-			"conn_idle_time": dbPool.Config().MaxConnIdleTime.String(),
-		},
+
+	switch {
+	case cfg.auth.mode != "token" && cfg.auth.mode != "jwt":
+		logger.PrintFatal(fmt.Errorf("unknown auth mode %q", cfg.auth.mode), nil)
+	case cfg.auth.mode == "jwt" && len(cfg.auth.jwtSecret) < 32:
+		logger.PrintFatal(errors.New("-jwt-secret must be at least 32 bytes long in jwt auth mode"), nil)
+	}
+
+	if u, err := url.Parse(cfg.auth.magicLinkURL); err != nil || !u.IsAbs() {
+		logger.PrintFatal(errors.New("-magic-link-url must be an absolute URL"), nil)
+	}
+
+	// Failures are still counted when a lock expires, so that repeated locks get longer.
+	if cfg.lockout.window < cfg.lockout.maxDuration {
+		logger.PrintFatal(errors.New("-lockout-window must not be shorter than -lockout-max-duration"), nil)
+	}
+
+	if cfg.oidc.issuer != "" && (cfg.oidc.clientID == "" || cfg.oidc.redirectURL == "") {
+		logger.PrintFatal(errors.New("-oidc-client-id and -oidc-redirect-url are required with -oidc-issuer"), nil)
+	}
+
+	// Run the "migrate" subcommand instead of the server if it was requested.
+	if flag.Arg(0) == "migrate" {
+		dbPool, err := openDB(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		err = runMigrateCommand(dbPool, flag.Args()[1:])
+		dbPool.Close()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		os.Exit(0)
+	}
+
+	var (
+		models data.Models
+		dbPool *pgxpool.Pool
 	)
 
+	switch cfg.store {
+	case "postgres":
+		var err error
+		dbPool, err = openDB(cfg)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		defer dbPool.Close()
+		logger.PrintInfo(
+			"database connection established",
+			map[string]string{
+				"max_conns":      strconv.Itoa(int((dbPool.Config().MaxConns))),
+				"conn_idle_time": dbPool.Config().MaxConnIdleTime.String(),
+			},
+		)
+
+		if cfg.db.automigrate {
+			err = autoMigrate(dbPool)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			logger.PrintInfo("database migrations applied", nil)
+		}
+
+		publishDBMetrics(dbPool)
+		models = data.NewModels(dbPool)
+	case "memory":
+		// Nothing is persisted in this mode, so it's only meant for local demos and testing.
+		logger.PrintInfo("using in-memory data store", nil)
+		models = data.NewMemoryModels()
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown data store %q", cfg.store), nil)
+	}
+
+	// Canceled before the deferred dbPool.Close() runs, which waits for the connections
+	// of the cache listeners to be released.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if cfg.permissionCache.size > 0 {
+		cache := data.NewPermissionCache(cfg.permissionCache.size, cfg.permissionCache.ttl)
+		models.CachePermissions(cache)
+		expvar.Publish("permission_cache", expvar.Func(func() any {
+			return cache.Stats()
+		}))
+		if dbPool != nil {
+			go listenForChanges(ctx, cache, dbPool, logger)
+		}
+	}
+
+	if cfg.statusCache.size > 0 {
+		cache := data.NewUserStatusCache(cfg.statusCache.size, cfg.statusCache.ttl)
+		models.CacheUserStatus(cache)
+		expvar.Publish("status_cache", expvar.Func(func() any {
+			return cache.Stats()
+		}))
+		if dbPool != nil {
+			go listenForChanges(ctx, cache, dbPool, logger)
+		}
+	}
+
+	transport, err := newMailTransport(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	// Publish version in metrics.
 	expvar.NewString("version").Set(version)
 	// Publish the number of active goroutines.
 	expvar.Publish("goroutines", expvar.Func(func() any {
 		return runtime.NumGoroutine()
 	}))
-	// Publish the database connection pool statistics in a serializable format.
+	// Publish the current Unix timestamp.
+	expvar.Publish("timestamp", expvar.Func(func() any {
+		return time.Now().Unix()
+	}))
+
+	app := &application{
+		config:     cfg,
+		logger:     logger,
+		models:     models,
+		mailer:     mailer.New(transport, cfg.smtp.sender),
+		outboxWake: make(chan struct{}, 1),
+	}
+
+	if cfg.oidc.issuer != "" {
+		app.oidc = oidc.New(oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+		})
+	}
+
+	err = app.serve() // start the HTTP server
+	if err != nil {
+		logger.PrintFatal(err, nil) // log the error and exit
+	}
+}
+
+// Create the mail transport selected with the -mailer flag. The log transport drops the
+// emails, which the outbox then considers sent, so it's only the default in development,
+// and using it elsewhere gets a warning. There's no choice of the memory transport, as
+// nothing outside the process could read the emails it keeps; tests which need to check
+// emails create a mailer.MemoryTransport directly.
+func newMailTransport(cfg config, logger *jsonlog.Logger) (mailer.Transport, error) {
+	transport := cfg.mailer.transport
+	if transport == "" {
+		transport = "smtp"
+		if cfg.env == "development" {
+			transport = "log"
+		}
+	}
+
+	switch transport {
+	case "smtp":
+		return mailer.NewSMTPTransport(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFileTransport(cfg.mailer.dir)
+	case "log":
+		if cfg.env != "development" {
+			logger.PrintError(errors.New("emails are logged and dropped instead of sent"), map[string]string{"mailer": transport, "env": cfg.env})
+		}
+		return mailer.NewLogTransport(logger), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", transport)
+	}
+}
+
+// A cache which is kept in sync with changes announced by the database.
+type listeningCache interface {
+	Listen(ctx context.Context, db *pgxpool.Pool) error
+	Channel() string
+}
+
+// Keep a cache in sync with changes announced by the database, reconnecting after a
+// short delay whenever the connection fails, until ctx is canceled.
+func listenForChanges(ctx context.Context, cache listeningCache, dbPool *pgxpool.Pool, logger *jsonlog.Logger) {
+	for {
+		err := cache.Listen(ctx, dbPool)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.PrintError(err, map[string]string{"listener": cache.Channel()})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Publish the database connection pool statistics in a serializable format.
+func publishDBMetrics(dbPool *pgxpool.Pool) {
 	expvar.Publish("database", expvar.Func(func() any {
 		stats := dbPool.Stat()
 		return map[string]interface{}{
@@ -130,22 +433,6 @@ func main() {
 			"total_conns":                stats.TotalConns(),
 		}
 	}))
-	// Publish the current Unix timestamp.
-	expvar.Publish("timestamp", expvar.Func(func() any {
-		return time.Now().Unix()
-	}))
-
-	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(dbPool),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
-	}
-
-	err = app.serve() // start the HTTP server
-	if err != nil {
-		logger.PrintFatal(err, nil) // log the error and exit
-	}
 }
 
 func openDB(cfg config) (*pgxpool.Pool, error) {
@@ -12,6 +12,7 @@ import (
 
 	"github.com/felixge/httpsnoop"
 	"github.com/igredk/greenlight/internal/data"
+	"github.com/igredk/greenlight/internal/jwt"
 	"github.com/igredk/greenlight/internal/validator"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
@@ -126,6 +127,17 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		token := headerParts[1] // extract the actual authentication token from the header parts
 
+		// API keys are told apart from tokens by their prefix, and access tokens by
+		// their shape.
+		if data.IsAPIKey(token) {
+			app.authenticateAPIKey(w, r, next, token)
+			return
+		}
+		if jwt.LooksLikeToken(token) {
+			app.authenticateAccessToken(w, r, next, token)
+			return
+		}
+
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
@@ -134,7 +146,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Retrieve the details of the user associated with the authentication token using ScopeAuthentication.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -145,12 +157,110 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// The tokens of suspended users are deleted, so this only catches a token which
+		// was issued while the user was being suspended.
+		if user.Suspended {
+			app.accountSuspendedResponse(w, r)
+			return
+		}
+
+		err = app.models.Tokens.Touch(r.Context(), data.TokenHash(token))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		r = app.contextSetUser(r, user) // add the user information to the request context
+		r = app.contextSetToken(r, token)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// Authenticate a request made with an API key. The key, rather than a token, is added to the
+// request context, so that requirePermission() can restrict the request to its permissions.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	key, err := app.models.APIKeys.GetByHash(r.Context(), data.TokenHash(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), key.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// API keys are kept when a user is suspended, so that they work again once the
+	// suspension is lifted.
+	if user.Suspended {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	err = app.models.APIKeys.Touch(r.Context(), key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
+// Authenticate a request made with an access token. The user is built from the token's
+// claims and their status, which is looked up on every request (through the status
+// cache, if enabled), so that deactivating or suspending a user takes effect right away.
+// It only has its ID and activation status set, so handlers which need more of the user
+// must be wrapped with loadCurrentUser().
+func (app *application) authenticateAccessToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	claims, err := app.parseAccessToken(token)
+	if err != nil {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	status, err := app.models.Users.GetStatus(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if status.Suspended {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	r = app.contextSetUser(r, &data.User{ID: id, Activated: status.Activated})
+	r = app.contextSetAccessClaims(r, claims)
+
+	next.ServeHTTP(w, r)
+}
+
 // Instead of accepting and returning a http.Handler, mw's below accept and return a http.HandlerFunc.
 // This makes it possible to wrap handler functions directly with such middlewares,
 // without needing to make any further conversions.
@@ -192,14 +302,22 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r) // retrieve the user from the request context
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		// Get the slice of permissions for the user. Access tokens carry them in their claims.
+		var permissions data.Permissions
+		if claims := app.contextGetAccessClaims(r); claims != nil {
+			permissions = claims.Permissions
+		} else {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 		// Check if the slice includes the required permission. If it doesn't, then return a 403 Forbidden response.
-		if !permissions.Include(code) {
+		// Requests made with an API key are further limited to the permissions of the key.
+		key := app.contextGetAPIKey(r)
+		if !permissions.Include(code) || (key != nil && !key.Permissions.Include(code)) {
 			app.notPermittedResponse(w, r)
 			return
 		}
@@ -211,6 +329,48 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	return app.requireActivatedUser(fn)
 }
 
+// Middleware for account management endpoints, which can only be used with a token from
+// logging in, so that a leaked API key can't be used to take over the account.
+func (app *application) rejectAPIKeys(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.apiKeyNotAllowedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware for handlers which read or change the account of the current user, and so
+// need the whole user record rather than the partial user of an access token.
+func (app *application) loadCurrentUser(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAccessClaims(r) == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.models.Users.Get(r.Context(), app.contextGetUser(r).ID)
+		if err != nil {
+			switch {
+			// The user has been deleted since the access token was issued.
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if user.Suspended {
+			app.accountSuspendedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, app.contextSetUser(r, user))
+	})
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary" header to warn any caches that the response may be different.
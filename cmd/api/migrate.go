@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/igredk/greenlight/internal/migrate"
+	"github.com/igredk/greenlight/migrations"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const migrateUsage = "usage: api [flags] migrate up|down|status|goto N"
+
+// The runMigrateCommand() function implements the "migrate" subcommand. args holds the
+// command line arguments following the "migrate" keyword.
+func runMigrateCommand(dbPool *pgxpool.Pool, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	m, err := migrate.New(dbPool, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		err = m.Up(ctx)
+	case args[0] == "down" && len(args) == 1:
+		err = m.Down(ctx)
+	case args[0] == "goto" && len(args) == 2:
+		version, convErr := strconv.ParseInt(args[1], 10, 64)
+		if convErr != nil || version < 0 {
+			return fmt.Errorf("invalid migration version %q", args[1])
+		}
+		err = m.Goto(ctx, version)
+	case args[0] == "status" && len(args) == 1:
+		return printMigrationStatus(ctx, m)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		fmt.Println("no change")
+		return nil
+	}
+
+	return err
+}
+
+func printMigrationStatus(ctx context.Context, m *migrate.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+
+	return tw.Flush()
+}
+
+// Apply all pending migrations, used for the -db-automigrate flag.
+func autoMigrate(dbPool *pgxpool.Pool) error {
+	m, err := migrate.New(dbPool, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	err = m.Up(context.Background())
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return err
+	}
+
+	return nil
+}
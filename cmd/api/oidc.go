@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/igredk/greenlight/internal/data"
+	"github.com/igredk/greenlight/internal/oidc"
+	"github.com/igredk/greenlight/internal/validator"
+)
+
+// Start a login with the OpenID Connect provider. The client sends the user to the
+// returned authorization URL, and once they have logged in there the provider redirects
+// them to the configured redirect URL with a code and the state. The client then exchanges
+// both for an authentication token with createOIDCAuthenticationTokenHandler.
+func (app *application) createOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	state, err := oidc.GenerateNonce()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	nonce, err := oidc.GenerateNonce()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	verifier, err := oidc.GenerateVerifier()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := app.oidc.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		app.identityProviderErrorResponse(w, r, err)
+		return
+	}
+
+	// The nonce and code verifier never leave the server, so that a stolen code is useless
+	// without the state it was issued for.
+	err = app.models.OIDCLogins.Insert(r.Context(), &data.OIDCLogin{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		Expiry:       time.Now().Add(10 * time.Minute),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"authorization_url": authURL, "state": state}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Complete a login with the OpenID Connect provider by redeeming the code it sent back
+// for an ID token. The user is looked up by the verified email address in the ID token,
+// and created if there is none yet. Since the provider vouches for the address, such
+// users are activated right away, along with existing users who hadn't activated yet.
+func (app *application) createOIDCAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, err := app.models.OIDCLogins.Consume(r.Context(), input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	idToken, err := app.oidc.Exchange(r.Context(), input.Code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		var oauthErr *oidc.Error
+		switch {
+		case errors.As(err, &oauthErr) && oauthErr.Code == "invalid_grant":
+			// The code is invalid, expired or has already been used. Other OAuth errors,
+			// like invalid_client, mean that the API is misconfigured.
+			app.invalidCredentialsResponse(w, r)
+		case errors.Is(err, oidc.ErrInvalidIDToken), errors.Is(err, oidc.ErrUnknownKey):
+			app.logError(r, err)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.identityProviderErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if idToken.Email == "" || !idToken.EmailVerified {
+		app.emailNotVerifiedResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), idToken.Email)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		user, err = app.createOIDCUser(r, idToken, v)
+		if errors.Is(err, data.ErrDuplicateEmail) {
+			// Created by a concurrent login in the meantime.
+			user, err = app.models.Users.GetByEmail(r.Context(), idToken.Email)
+		}
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if user.Suspended {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	if !user.Activated {
+		// Nothing proves that whoever registered the account owns the address, so they
+		// may have chosen the password to take over the account once its owner starts
+		// using it. Replace the password and revoke everything issued so far.
+		user.Activated = true
+
+		err = app.setRandomPassword(user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.Users.Update(r.Context(), user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.models.Tokens.DeleteAllScopesForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.models.APIKeys.DeleteAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	// The provider only replaces the password, so the second factor is still required.
+	twoFactor, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if twoFactor != nil && twoFactor.Enabled {
+		app.sendTwoFactorChallenge(w, r, user)
+		return
+	}
+
+	app.sendAuthenticationToken(w, r, user)
+}
+
+// Create an activated user with the default role for an ID token. The user gets a random
+// password, which they can replace by requesting a password reset if they ever want to
+// log in without the provider. If the claims don't make a valid user, the errors are
+// added to v and a nil user is returned.
+func (app *application) createOIDCUser(r *http.Request, idToken *oidc.IDToken, v *validator.Validator) (*data.User, error) {
+	name := strings.TrimSpace(idToken.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(idToken.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     idToken.Email,
+		Activated: true,
+	}
+
+	err := app.setRandomPassword(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, nil
+	}
+
+	err = app.models.Users.InsertWithRole(r.Context(), user, data.DefaultRole)
+	if err != nil {
+		return nil, err
+	}
+
+	app.audit(r, user.ID, data.AuditOIDCUserCreated, map[string]any{
+		"issuer":  idToken.Issuer,
+		"subject": idToken.Subject,
+	})
+
+	return user, nil
+}
+
+// Give a user a random password that nobody knows.
+func (app *application) setRandomPassword(user *data.User) error {
+	password, err := oidc.GenerateNonce()
+	if err != nil {
+		return err
+	}
+
+	return user.Password.Set(password)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/igredk/greenlight/internal/data"
+)
+
+const (
+	// How often idle workers check the outbox for emails which became due.
+	outboxPollInterval = 5 * time.Second
+	// How long a claimed email is reserved for the worker sending it. This must be well
+	// above the mailer timeout, or another worker could send the email a second time.
+	outboxLease = time.Minute
+	// Delay before the first retry of a failed email, doubled on every further attempt
+	// up to outboxMaxBackoff.
+	outboxBaseBackoff = 30 * time.Second
+	outboxMaxBackoff  = time.Hour
+)
+
+// Add an email to the outbox and wake up a worker to send it. The email is stored in
+// the database, so it will be delivered even if the mail server is down right now or
+// the process restarts before getting to it. The template data, which often holds a
+// token, is only kept until the email has been sent or given up on.
+func (app *application) enqueueEmail(r *http.Request, recipient, templateFile string, templateData map[string]any) error {
+	email := &data.Email{
+		Recipient: recipient,
+		Template:  templateFile,
+		Data:      templateData,
+	}
+
+	err := app.models.Outbox.Enqueue(r.Context(), email)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case app.outboxWake <- struct{}{}:
+	default: // a wake-up is already pending
+	}
+
+	return nil
+}
+
+// Start the outbox workers. They run until stop is closed and are tracked by app.wg, so
+// shutdown waits for emails which are being sent to finish.
+func (app *application) startOutboxWorkers(stop <-chan struct{}) {
+	for range app.config.outbox.workers {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			app.outboxWorker(stop)
+		}()
+	}
+}
+
+func (app *application) outboxWorker(stop <-chan struct{}) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Send emails one at a time until there are none left which are due, checking
+		// for shutdown in between.
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			sent, err := app.sendNextEmail()
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+			if !sent {
+				break
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-app.outboxWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Claim and send the next due email, reporting if there was one.
+func (app *application) sendNextEmail() (bool, error) {
+	// Don't derive from a request or shutdown context, so that the outcome of an email
+	// which has been sent is always recorded.
+	ctx := context.Background()
+
+	emails, err := app.models.Outbox.Claim(ctx, 1, outboxLease)
+	if err != nil || len(emails) == 0 {
+		return false, err
+	}
+	email := emails[0]
+
+	err = app.sendEmail(email)
+	if err == nil {
+		return true, app.models.Outbox.MarkSent(ctx, email.ID)
+	}
+
+	properties := map[string]string{
+		"email_id": strconv.FormatInt(email.ID, 10),
+		"template": email.Template,
+		"attempts": strconv.Itoa(email.Attempts),
+	}
+
+	if email.Attempts >= app.config.outbox.maxAttempts {
+		app.logger.PrintError(fmt.Errorf("giving up on email: %w", err), properties)
+		return true, app.models.Outbox.MarkDead(ctx, email.ID, err.Error())
+	}
+
+	retryAt := time.Now().Add(outboxBackoff(email.Attempts))
+	properties["retry_at"] = retryAt.Format(time.RFC3339)
+	app.logger.PrintError(fmt.Errorf("sending email: %w", err), properties)
+
+	return true, app.models.Outbox.MarkFailed(ctx, email.ID, err.Error(), retryAt)
+}
+
+// Send an email, turning a panic in the mailer into an error so that the email is
+// retried rather than the worker being lost.
+func (app *application) sendEmail(email *data.Email) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s", p)
+		}
+	}()
+
+	return app.mailer.Send(email.Recipient, email.Template, email.Data)
+}
+
+// Return the delay before retrying an email which has failed the given number of times.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, outboxMaxBackoff)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/igredk/greenlight/internal/data"
+	"github.com/igredk/greenlight/internal/validator"
+)
+
+// Read the user from the "id" URL parameter, sending a 404 Not Found response if there's
+// no such user. The returned bool reports if the caller can continue.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// Send the user's direct permissions together with the effective ones, which also
+// include the permissions of the user's roles.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	direct, err := app.models.Permissions.GetDirectForUser(r.Context(), userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	effective, err := app.models.Permissions.GetAllForUser(r.Context(), userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": direct, "effective_permissions": effective}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Read and validate the list of permission codes in the request body.
+func (app *application) readPermissionCodes(w http.ResponseWriter, r *http.Request, allowEmpty bool) ([]string, bool) {
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+	v.Check(input.Permissions != nil, "permissions", "must be provided")
+	v.Check(allowEmpty || len(input.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+
+	err = app.validatePermissionCodes(r, v, input.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	return input.Permissions, true
+}
+
+func (app *application) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// Replace all direct permissions of a user. Sending an empty list revokes them all,
+// while permissions granted through roles are left untouched.
+func (app *application) replaceUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	codes, ok := app.readPermissionCodes(w, r, true)
+	if !ok {
+		return
+	}
+
+	before, err := app.models.Permissions.GetDirectForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Permissions.ReplaceForUser(r.Context(), user.ID, codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, user.ID, data.AuditPermissionsReplaced, map[string]any{"before": before, "after": codes})
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+func (app *application) removeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	codes, ok := app.readPermissionCodes(w, r, false)
+	if !ok {
+		return
+	}
+
+	err := app.models.Permissions.RemoveForUser(r.Context(), user.ID, codes...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, user.ID, data.AuditPermissionsRemoved, map[string]any{"removed": codes})
+
+	app.writeUserPermissions(w, r, user.ID)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Base URI of the problem type URIs. Appending an error code yields the type of a
+// problem+json response, e.g. https://greenlight.com/problems/edit-conflict.
+const problemTypeBaseURI = "https://greenlight.com/problems/"
+
+// Stable, machine-readable codes for every kind of error response. Clients should rely on
+// these (or the type URIs derived from them) rather than on the human-readable messages.
+const (
+	errCodeBadRequest                 = "bad-request"
+	errCodeValidationFailed           = "validation-failed"
+	errCodeNotFound                   = "not-found"
+	errCodeMethodNotAllowed           = "method-not-allowed"
+	errCodeEditConflict               = "edit-conflict"
+	errCodeRateLimitExceeded          = "rate-limit-exceeded"
+	errCodeInvalidCredentials         = "invalid-credentials"
+	errCodeAccountLocked              = "account-locked"
+	errCodeAccountSuspended           = "account-suspended"
+	errCodeInvalidAuthenticationToken = "invalid-authentication-token"
+	errCodeAuthenticationRequired     = "authentication-required"
+	errCodeInactiveAccount            = "inactive-account"
+	errCodeNotPermitted               = "not-permitted"
+	errCodeAPIKeyNotAllowed           = "api-key-not-allowed"
+	errCodeEmailNotVerified           = "email-not-verified"
+	errCodeIdentityProviderError      = "identity-provider-error"
+	errCodeServerError                = "server-error"
+	errCodeServiceUnavailable         = "service-unavailable"
+	errCodeClientClosedRequest        = "client-closed-request"
+)
+
+// Short, human-readable summaries for each error code, used as the problem title.
+var problemTitles = map[string]string{
+	errCodeBadRequest:                 "Bad request",
+	errCodeValidationFailed:           "Validation failed",
+	errCodeNotFound:                   "Resource not found",
+	errCodeMethodNotAllowed:           "Method not allowed",
+	errCodeEditConflict:               "Edit conflict",
+	errCodeRateLimitExceeded:          "Rate limit exceeded",
+	errCodeInvalidCredentials:         "Invalid credentials",
+	errCodeAccountLocked:              "Account locked",
+	errCodeAccountSuspended:           "Account suspended",
+	errCodeInvalidAuthenticationToken: "Invalid authentication token",
+	errCodeAuthenticationRequired:     "Authentication required",
+	errCodeInactiveAccount:            "Inactive account",
+	errCodeNotPermitted:               "Not permitted",
+	errCodeAPIKeyNotAllowed:           "API key not allowed",
+	errCodeEmailNotVerified:           "Email not verified",
+	errCodeIdentityProviderError:      "Identity provider error",
+	errCodeServerError:                "Internal server error",
+	errCodeServiceUnavailable:         "Service unavailable",
+	errCodeClientClosedRequest:        "Client closed request",
+}
+
+// A problem is an RFC 7807 problem details object. Validation failures are reported in
+// the "errors" extension member, keyed by field name.
+type problem struct {
+	Type     string            `json:"type"`
+	Title    string            `json:"title"`
+	Status   int               `json:"status"`
+	Detail   string            `json:"detail,omitempty"`
+	Instance string            `json:"instance"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// Decide whether to send an application/problem+json error response. Clients can ask for
+// one explicitly with the Accept header, otherwise the -error-format setting applies.
+func (app *application) wantsProblemJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accepted)
+		if err == nil && mediaType == "application/problem+json" {
+			return true
+		}
+	}
+
+	return app.config.errorFormat == "problem"
+}
+
+// Write a problem+json response. It mirrors writeJSON(), only with a different body and
+// content type.
+func (app *application) writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, message any) error {
+	p := problem{
+		Type:     problemTypeBaseURI + code,
+		Title:    problemTitles[code],
+		Status:   status,
+		Instance: r.URL.Path,
+	}
+
+	switch message := message.(type) {
+	case map[string]string:
+		p.Detail = "one or more fields failed validation"
+		p.Errors = message
+	case string:
+		p.Detail = message
+	}
+
+	js, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(js)
+
+	return nil
+}
@@ -3,33 +3,104 @@ package main
 import (
 	"expvar"
 	"net/http"
-
-	"github.com/julienschmidt/httprouter"
+	"strings"
 )
 
-func (app *application) routes() http.Handler {
-	router := httprouter.New()
-
-	// Custom error handler for 404 Not Found responses.
-	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+// Methods which are checked for when looking for the methods a path supports.
+var routeMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
 
-	// Custom error handler for 405 Method Not Allowed responses.
-	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+func (app *application) routes() http.Handler {
+	// http.ServeMux patterns take precedence by specificity, so static routes like
+	// "/v1/users/activate" can live next to wildcard routes like "/v1/users/{id}/roles".
+	router := http.NewServeMux()
 	// healthcheck
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	router.HandleFunc("GET /v1/healthcheck", app.healthcheckHandler)
 	// metrics
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.Handle("GET /debug/vars", expvar.Handler())
 	// movies
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	router.HandleFunc("GET /v1/movies", app.requirePermission("movies:read", app.listMoviesHandler))
+	router.HandleFunc("POST /v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	router.HandleFunc("GET /v1/movies/{id}", app.requirePermission("movies:read", app.showMovieHandler))
+	router.HandleFunc("PATCH /v1/movies/{id}", app.requirePermission("movies:write", app.updateMovieHandler))
+	router.HandleFunc("DELETE /v1/movies/{id}", app.requirePermission("movies:write", app.deleteMovieHandler))
 	// users
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activate", app.activateUserHandler)
+	router.HandleFunc("POST /v1/users", app.registerUserHandler)
+	router.HandleFunc("PUT /v1/users/activate", app.activateUserHandler)
+	router.HandleFunc("PUT /v1/users/password", app.updateUserPasswordHandler)
+	router.HandleFunc("GET /v1/users/me", app.requireAuthenticatedUser(app.loadCurrentUser(app.showCurrentUserHandler)))
+	router.HandleFunc("PATCH /v1/users/me", app.requireActivatedUser(app.rejectAPIKeys(app.loadCurrentUser(app.updateCurrentUserHandler))))
+	router.HandleFunc("PUT /v1/users/me/password", app.requireActivatedUser(app.rejectAPIKeys(app.loadCurrentUser(app.updateCurrentUserPasswordHandler))))
+	router.HandleFunc("POST /v1/users/me/email", app.requireActivatedUser(app.rejectAPIKeys(app.loadCurrentUser(app.requestEmailChangeHandler))))
+	router.HandleFunc("PUT /v1/users/email", app.confirmEmailChangeHandler)
+	router.HandleFunc("PUT /v1/users/unlock", app.unlockUserHandler)
+	router.HandleFunc("GET /v1/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandleFunc("GET /v1/users/{id}", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandleFunc("PATCH /v1/users/{id}", app.requirePermission("users:admin", app.updateUserHandler))
+	// two-factor authentication
+	router.HandleFunc("POST /v1/users/me/two-factor", app.requireActivatedUser(app.rejectAPIKeys(app.loadCurrentUser(app.createTwoFactorHandler))))
+	router.HandleFunc("PUT /v1/users/me/two-factor", app.requireActivatedUser(app.rejectAPIKeys(app.loadCurrentUser(app.enableTwoFactorHandler))))
+	router.HandleFunc("DELETE /v1/users/me/two-factor", app.requireActivatedUser(app.rejectAPIKeys(app.loadCurrentUser(app.deleteTwoFactorHandler))))
+	// API keys
+	router.HandleFunc("GET /v1/api-keys", app.requireActivatedUser(app.rejectAPIKeys(app.listAPIKeysHandler)))
+	router.HandleFunc("POST /v1/api-keys", app.requireActivatedUser(app.rejectAPIKeys(app.createAPIKeyHandler)))
+	router.HandleFunc("DELETE /v1/api-keys/{id}", app.requireActivatedUser(app.rejectAPIKeys(app.deleteAPIKeyHandler)))
+	// roles
+	router.HandleFunc("GET /v1/roles", app.requirePermission("users:admin", app.listRolesHandler))
+	router.HandleFunc("POST /v1/roles", app.requirePermission("users:admin", app.createRoleHandler))
+	router.HandleFunc("POST /v1/roles/{name}/permissions", app.requirePermission("users:admin", app.addRolePermissionsHandler))
+	router.HandleFunc("GET /v1/users/{id}/roles", app.requirePermission("users:admin", app.listUserRolesHandler))
+	router.HandleFunc("POST /v1/users/{id}/roles", app.requirePermission("users:admin", app.assignUserRoleHandler))
+	router.HandleFunc("DELETE /v1/users/{id}/roles/{name}", app.requirePermission("users:admin", app.unassignUserRoleHandler))
+	// permissions
+	router.HandleFunc("GET /v1/users/{id}/permissions", app.requirePermission("users:admin", app.listUserPermissionsHandler))
+	router.HandleFunc("PUT /v1/users/{id}/permissions", app.requirePermission("users:admin", app.replaceUserPermissionsHandler))
+	router.HandleFunc("DELETE /v1/users/{id}/permissions", app.requirePermission("users:admin", app.removeUserPermissionsHandler))
 	// tokens
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandleFunc("GET /v1/tokens", app.requireAuthenticatedUser(app.rejectAPIKeys(app.listSessionsHandler)))
+	router.HandleFunc("DELETE /v1/tokens/{id}", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteSessionHandler)))
+	router.HandleFunc("POST /v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandleFunc("POST /v1/tokens/authentication/two-factor", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandleFunc("POST /v1/tokens/authentication/magic-link", app.createMagicLinkAuthenticationTokenHandler)
+	router.HandleFunc("POST /v1/tokens/authentication/oidc", app.createOIDCAuthenticationTokenHandler)
+	router.HandleFunc("POST /v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandleFunc("DELETE /v1/tokens/authentication", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteAuthenticationTokenHandler)))
+	router.HandleFunc("DELETE /v1/tokens/authentication/all", app.requireAuthenticatedUser(app.rejectAPIKeys(app.deleteAllAuthenticationTokensHandler)))
+	router.HandleFunc("POST /v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandleFunc("POST /v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandleFunc("POST /v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.HandleFunc("POST /v1/tokens/oidc", app.createOIDCLoginHandler)
+
+	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(app.handleUnmatched(router))))))
+}
+
+// The handleUnmatched() middleware sends our JSON error responses for requests which don't
+// match any route, instead of the plain text ones http.ServeMux would send. Like
+// httprouter did, OPTIONS requests are answered automatically with an Allow header.
+func (app *application) handleUnmatched(router *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := router.Handler(r); pattern != "" {
+			router.ServeHTTP(w, r)
+			return
+		}
+		// Find out which methods the path supports, to tell a 404 from a 405.
+		var allowed []string
+		for _, method := range routeMethods {
+			probe := r.Clone(r.Context())
+			probe.Method = method
+			if _, pattern := router.Handler(probe); pattern != "" {
+				allowed = append(allowed, method)
+			}
+		}
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+		switch {
+		case len(allowed) == 0:
+			app.notFoundResponse(w, r)
+		case r.Method == http.MethodOptions:
+			w.Header().Set("Allow", strings.Join(append(allowed, http.MethodOptions), ", "))
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			app.methodNotAllowedResponse(w, r)
+		}
+	})
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,16 +12,33 @@ import (
 	"time"
 )
 
+// Cause attached to the request contexts when in-flight requests are aborted during shutdown.
+var errServerShutdown = errors.New("server is shutting down")
+
 func (app *application) serve() error {
+	// All request contexts derive from baseCtx, so canceling it aborts any in-flight
+	// database queries of requests that are still running when shutdown times out.
+	baseCtx, cancelBaseCtx := context.WithCancelCause(context.Background())
+	defer cancelBaseCtx(nil)
+
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 
-	shutdownError := make(chan error) // channel to receive any errors returned by the Shutdown() function
+	// Closed on shutdown to stop the outbox workers from picking up further emails.
+	stopWorkers := make(chan struct{})
+	app.startOutboxWorkers(stopWorkers)
+
+	// Channel to receive the error returned by the Shutdown() function, once background
+	// tasks have completed. It's buffered so that the goroutine below never blocks on it.
+	shutdownError := make(chan error, 1)
 
 	// Start a background goroutine.
 	go func() {
@@ -42,18 +60,22 @@ func (app *application) serve() error {
 		// Shutdown() will return nil if the shutdown was successful, or an
 		// error (which may happen because of a problem closing the listeners, or
 		// because the shutdown didn't complete before the 10-second context deadline is hit).
-		// If Shutdown() returns an error, send it on the shutdownError channel.
 		err := srv.Shutdown(ctx)
 		if err != nil {
-			shutdownError <- err
+			// Requests that are still running past the deadline have their contexts
+			// canceled, so they stop waiting on the database and respond promptly.
+			cancelBaseCtx(errServerShutdown)
 		}
-		// Log a message to say that we're waiting for any background goroutines to complete their tasks.
+		// Log a message to say that we're waiting for any background goroutines to complete
+		// their tasks. This happens even if Shutdown() failed, so that emails which are being
+		// sent aren't abandoned and sent again once their lease expires.
 		app.logger.PrintInfo("completing background tasks", map[string]string{"addr": srv.Addr})
+		close(stopWorkers)
 		// Call Wait() to block until our WaitGroup counter is zero essentially
-		// blocking until the background goroutines have finished. Then we return nil on
-		// the shutdownError channel, to indicate that the shutdown completed without any issues.
+		// blocking until the background goroutines have finished. Then we send the
+		// return value from Shutdown() on the shutdownError channel.
 		app.wg.Wait()
-		shutdownError <- nil
+		shutdownError <- err
 	}()
 
 	app.logger.PrintInfo("starting server", map[string]string{"addr": srv.Addr, "env": app.config.env})
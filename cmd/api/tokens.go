@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/igredk/greenlight/internal/data"
@@ -30,38 +33,551 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// Refuse to check any more passwords while logins with this email address are locked.
+	// This works the same whether or not there is a user for it.
+	attempts, err := app.models.LoginAttempts.Get(r.Context(), input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if attempts.Locked(time.Now()) {
+		app.accountLockedResponse(w, r, attempts.LockedUntil)
+		return
+	}
 	// Lookup the user record based on the email address.
-	// If no matching user was found, send a 401 Unauthorized response to the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Check if the provided password matches the actual password for the user. If there
+	// is no such user, compare against a dummy hash instead, so that the response doesn't
+	// come back faster and give away that the email address isn't registered.
+	match := false
+	if user != nil {
+		match, err = user.Password.Matches(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		data.SimulatePasswordCheck(input.Password)
+	}
+	// If the passwords don't match, send a 401 Unauthorized response to the client.
+	if !match {
+		err = app.recordFailedLogin(r, input.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	// Logging in is the only time the plaintext password is known, so this is when a hash
+	// made with an older algorithm or weaker parameters can be upgraded.
+	if user.Password.NeedsRehash() {
+		app.rehashPassword(r, user, input.Password)
+	}
+
+	// With two-factor authentication enabled the password is only the first step, and the
+	// client gets a short-lived token to complete the login with a code instead. Failed
+	// logins are only reset once the second step succeeds, so that the lockout limits
+	// guessing codes as well.
+	twoFactor, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if twoFactor != nil && twoFactor.Enabled {
+		app.sendTwoFactorChallenge(w, r, user)
+		return
+	}
+
+	err = app.models.LoginAttempts.Reset(r.Context(), user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendAuthenticationToken(w, r, user)
+}
+
+// Generate a new authentication token for a user who has logged in and send it to the client.
+// In jwt auth mode, an access token and a refresh token are sent instead. Every way of
+// logging in ends here, so this is where suspended users are turned away.
+func (app *application) sendAuthenticationToken(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.Suspended {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	if app.config.auth.mode == "jwt" {
+		app.sendAccessToken(w, r, user, nil)
+		return
+	}
+
+	// Generate a new token with a 24-hour expiry time and the scope 'authentication'.
+	token, err := app.models.Tokens.NewSession(r.Context(), user.ID, 24*time.Hour, app.client(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Encode the token to JSON and send it in the response along with a 201 Created status code.
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Check the password an authenticated user has to confirm before a sensitive change. It
+// goes through the same lockout as logging in, so that a stolen session can't be used to
+// guess the password. Unless the password matches, a response has been sent and false is
+// returned; key is the name of the input field the password was sent in.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, user *data.User, password, key string) bool {
+	attempts, err := app.models.LoginAttempts.Get(r.Context(), user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if attempts.Locked(time.Now()) {
+		app.accountLockedResponse(w, r, attempts.LockedUntil)
+		return false
+	}
+
+	match, err := user.Password.Matches(password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !match {
+		err = app.recordFailedLogin(r, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		v := validator.New()
+		v.AddError(key, "is incorrect")
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+// Count a failed login for the email address, and lock logins with it once there have been
+// too many in a row. Every further failure doubles the lock duration, starting at a minute.
+// user is nil if there is no user for the email address.
+func (app *application) recordFailedLogin(r *http.Request, email string, user *data.User) error {
+	var userID int64
+	if user != nil {
+		userID = user.ID
+	}
+
+	failures, err := app.models.LoginAttempts.RecordFailure(r.Context(), email, app.config.lockout.window)
+	if err != nil {
+		return err
+	}
+
+	app.audit(r, userID, data.AuditLoginFailed, map[string]any{
+		"email":    email,
+		"ip":       app.client(r).IP,
+		"failures": failures,
+	})
+
+	if failures < app.config.lockout.threshold {
+		return nil
+	}
+
+	duration := time.Minute
+	for i := app.config.lockout.threshold; i < failures && duration < app.config.lockout.maxDuration; i++ {
+		duration *= 2
+	}
+	until := time.Now().Add(min(duration, app.config.lockout.maxDuration))
+
+	err = app.models.LoginAttempts.Lock(r.Context(), email, until)
+	if err != nil {
+		return err
+	}
+
+	app.audit(r, userID, data.AuditAccountLocked, map[string]any{
+		"email":        email,
+		"locked_until": until,
+	})
+
+	if user == nil {
+		return nil
+	}
+	// Let the owner know, and give them a way to get back in right away. Older unlock
+	// tokens are replaced, as there's a new one with every lock.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeUnlock, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeUnlock)
+	if err != nil {
+		return err
+	}
+
+	return app.enqueueEmail(r, user.Email, "token_unlock.html", map[string]any{
+		"unlockToken": token.Plaintext,
+		"failures":    failures,
+	})
+}
+
+// Replace the password hash of a user with one made with the current algorithm and
+// parameters. This must not keep the user from logging in, so errors are only logged, and
+// if the user was changed concurrently, the hash is upgraded on the next login instead.
+func (app *application) rehashPassword(r *http.Request, user *data.User, plaintextPassword string) {
+	err := user.Password.Set(plaintextPassword)
+	if err == nil {
+		err = app.models.Users.Update(r.Context(), user)
+	}
+	if err != nil && !errors.Is(err, data.ErrEditConflict) {
+		app.logError(r, fmt.Errorf("rehashing password: %w", err))
+	}
+}
+
+// Revoke the authentication token that was used to authenticate the current request. For
+// an access token, which can't be revoked, the refresh tokens of its session are revoked
+// instead, so it can't be renewed once it expires.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if claims := app.contextGetAccessClaims(r); claims != nil {
+		err := app.models.Tokens.DeleteFamily(r.Context(), claims.Session)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token := app.contextGetToken(r)
+
+	err := app.models.Tokens.DeleteByHash(r.Context(), data.TokenHash(token))
 	if err != nil {
 		switch {
+		// The token may have been revoked by a concurrent request in the meantime.
 		case errors.Is(err, data.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
+			app.invalidAuthenticationTokenResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	// Check if the provided password matches the actual password for the user.
-	match, err := user.Password.Matches(input.Password)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "authentication token successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke all authentication tokens of the current user, logging them out everywhere.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeAuthentication, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// If the passwords don't match, send a 401 Unauthorized response to the client.
-	if !match {
-		app.invalidCredentialsResponse(w, r)
+	// Access tokens which have already been issued stay valid until they expire.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeRefresh, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Generate a new token with a 24-hour expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all authentication tokens successfully revoked"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Email a login token to a user who'd rather not use a password. As with activation tokens,
+// the response doesn't tell if there's an account for the email address.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an activated account exists for this email address, an email will be sent to it containing a login link"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && user.Activated {
+		// Only the latest login token can be used.
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeLogin, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(r.Context(), user.ID, 15*time.Minute, data.ScopeLogin)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		link, err := url.Parse(app.config.auth.magicLinkURL)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		query := link.Query()
+		query.Set("token", token.Plaintext)
+		link.RawQuery = query.Encode()
+
+		err = app.enqueueEmail(r, user.Email, "token_login.html", map[string]any{
+			"loginURL":   link.String(),
+			"loginToken": token.Plaintext,
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchange a login token for an authentication token, just like logging in with a
+// password. The login token is deleted on first use; of several concurrent requests with
+// the same token, only the one which gets to delete it succeeds.
+func (app *application) createMagicLinkAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeLogin, input.TokenPlaintext)
+	if err == nil {
+		err = app.models.Tokens.DeleteByHash(r.Context(), data.TokenHash(input.TokenPlaintext))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The email only replaces the password, so the second factor is still required.
+	twoFactor, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if twoFactor != nil && twoFactor.Enabled {
+		app.sendTwoFactorChallenge(w, r, user)
+		return
+	}
+
+	app.sendAuthenticationToken(w, r, user)
+}
+
+// List the sessions of the current user, that is their authentication tokens, or refresh
+// tokens in jwt auth mode, marking the one the request was made with.
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	claims := app.contextGetAccessClaims(r)
+	for _, session := range sessions {
+		if claims != nil {
+			session.Current = session.Family != "" && session.Family == claims.Session
+		} else {
+			session.Current = bytes.Equal(session.Hash, data.TokenHash(app.contextGetToken(r)))
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Revoke a session of the current user by its ID, signing out wherever it is used.
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteSession(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Generate a password reset token and send it to the user's email address. As with
+// activation tokens, the response doesn't tell if there's an account for the email
+// address.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an activated account exists for this email address, an email will be sent to it containing password reset instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Only activated users get a password reset token, with a 45-minute expiry time.
+	if user != nil && user.Activated {
+		token, err := app.models.Tokens.New(r.Context(), user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// Email the user with their password reset token.
+		err = app.enqueueEmail(r, user.Email, "token_password_reset.html", map[string]any{
+			"passwordResetToken": token.Plaintext,
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Generate a new activation token for a user whose previous one has expired or got
+// lost, and send it to the user's email address. The response is the same whether or
+// not there is an unactivated account for the email address, so that the endpoint can't
+// be used to find out which addresses are registered.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	env := envelope{"message": "if an unactivated account exists for this email address, an email will be sent to it containing activation instructions"}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !user.Activated {
+		// Revoke the old activation tokens, so that only the one sent now can be used.
+		err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.enqueueEmail(r, user.Email, "token_activation.html", map[string]any{
+			"activationToken": token.Plaintext,
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
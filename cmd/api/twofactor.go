@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/igredk/greenlight/internal/data"
+	"github.com/igredk/greenlight/internal/totp"
+	"github.com/igredk/greenlight/internal/validator"
+)
+
+const (
+	// Issuer shown next to the account in authenticator apps.
+	totpIssuer = "Greenlight"
+	// Number of time steps before and after the current one for which codes are accepted.
+	totpSkew = 1
+)
+
+// Start enabling two-factor authentication for the authenticated user. The response holds
+// the new secret, which the user adds to their authenticator app, and two-factor
+// authentication is enabled once they confirm a code from the app.
+func (app *application) createTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.SetPending(r.Context(), user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddError("two_factor", "is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, user.Email, secret),
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Enable two-factor authentication with a code from the authenticator app the user set
+// up with the pending secret. The response holds the recovery codes, which are shown to
+// the user this one time only.
+func (app *application) enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Code != "", "code", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	twoFactor, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if twoFactor == nil || twoFactor.Enabled {
+		v.AddError("two_factor", "there is no pending two-factor setup to confirm")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Validate(twoFactor.Secret, input.Code, time.Now(), totpSkew)
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Enable(r.Context(), user.ID, step, hashes)
+	if err != nil {
+		switch {
+		// Enabled by a concurrent request in the meantime.
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, user.ID, data.AuditTwoFactorEnabled, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Disable two-factor authentication for the authenticated user, who must confirm their
+// password.
+func (app *application) deleteTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if v.Check(input.Password != "", "password", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, input.Password, "password") {
+		return
+	}
+
+	err = app.models.TwoFactor.Delete(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.audit(r, user.ID, data.AuditTwoFactorDisabled, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Send a token for completing a login with two-factor authentication to a user who
+// provided the correct password.
+func (app *application) sendTwoFactorChallenge(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.Suspended {
+		app.accountSuspendedResponse(w, r)
+		return
+	}
+
+	// Only the latest challenge can be used.
+	err := app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 5*time.Minute, data.ScopeTwoFactor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"message":          "two-factor authentication required, send a code along with this token to POST /v1/tokens/authentication/two-factor",
+		"two_factor_token": token,
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Complete a login with two-factor authentication, exchanging the token from the first
+// step and either a TOTP code or a recovery code for an authentication token.
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "either code or recovery_code must be provided")
+	v.Check(input.Code == "" || input.RecoveryCode == "", "code", "only one of code and recovery_code may be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeTwoFactor, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Wrong codes count as failed logins, so the lockout applies here as well.
+	attempts, err := app.models.LoginAttempts.Get(r.Context(), user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if attempts.Locked(time.Now()) {
+		app.accountLockedResponse(w, r, attempts.LockedUntil)
+		return
+	}
+
+	twoFactor, err := app.models.TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		// Two-factor authentication was disabled after the first step.
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok := false
+	if input.Code != "" {
+		var step int64
+		step, ok = totp.Validate(twoFactor.Secret, input.Code, time.Now(), totpSkew)
+		if ok {
+			// A code which has been used already counts as a wrong one.
+			err = app.models.TwoFactor.UseStep(r.Context(), user.ID, step)
+		}
+	} else {
+		ok = true
+		err = app.models.TwoFactor.UseRecoveryCode(r.Context(), user.ID, data.RecoveryCodeHash(input.RecoveryCode))
+		if err == nil {
+			app.audit(r, user.ID, data.AuditRecoveryCodeUsed, nil)
+		}
+	}
+	if errors.Is(err, data.ErrRecordNotFound) {
+		ok, err = false, nil
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		err = app.recordFailedLogin(r, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.LoginAttempts.Reset(r.Context(), user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendAuthenticationToken(w, r, user)
+}
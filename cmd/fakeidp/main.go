@@ -0,0 +1,290 @@
+// Command fakeidp is a minimal OpenID Connect provider for developing and testing the
+// OIDC login of the API locally. It doesn't ask for credentials: every authorization
+// request is approved straight away for the user given with the flags, or for the email
+// address in the login_hint parameter if there is one. Never expose it to a network.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/igredk/greenlight/internal/jsonlog"
+	"github.com/igredk/greenlight/internal/jwt"
+)
+
+type config struct {
+	port          int
+	issuer        string
+	clientID      string
+	clientSecret  string
+	email         string
+	name          string
+	emailVerified bool
+}
+
+// An authorization is an issued code waiting to be redeemed at the token endpoint.
+type authorization struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	email         string
+	expiry        time.Time
+}
+
+type provider struct {
+	config config
+	logger *jsonlog.Logger
+	key    *rsa.PrivateKey
+	keyID  string
+
+	mu    sync.Mutex
+	codes map[string]*authorization
+}
+
+func main() {
+	var cfg config
+
+	flag.IntVar(&cfg.port, "port", 4010, "Server port")
+	flag.StringVar(&cfg.issuer, "issuer", "", "Issuer URL (default http://localhost:<port>)")
+	flag.StringVar(&cfg.clientID, "client-id", "greenlight", "Client ID of the API")
+	flag.StringVar(&cfg.clientSecret, "client-secret", "", "Client secret of the API (empty allows public clients)")
+	flag.StringVar(&cfg.email, "email", "alice@example.com", "Email address of the user to log in")
+	flag.StringVar(&cfg.name, "name", "Alice Smith", "Name of the user to log in")
+	flag.BoolVar(&cfg.emailVerified, "email-verified", true, "Claim that the email address is verified")
+	flag.Parse()
+
+	if cfg.issuer == "" {
+		cfg.issuer = fmt.Sprintf("http://localhost:%d", cfg.port)
+	}
+
+	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+
+	// A new key on every start, so tokens from a previous run don't verify anymore.
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	p := &provider{
+		config: cfg,
+		logger: logger,
+		key:    key,
+		keyID:  randomString(8),
+		codes:  make(map[string]*authorization),
+	}
+
+	srv := &http.Server{
+		Addr:         fmt.Sprintf(":%d", cfg.port),
+		Handler:      p.routes(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	logger.PrintInfo("starting fake identity provider", map[string]string{"addr": srv.Addr, "issuer": cfg.issuer})
+
+	err = srv.ListenAndServe()
+	logger.PrintFatal(err, nil)
+}
+
+func (p *provider) routes() http.Handler {
+	router := http.NewServeMux()
+
+	router.HandleFunc("GET /.well-known/openid-configuration", p.discoveryHandler)
+	router.HandleFunc("GET /jwks", p.jwksHandler)
+	router.HandleFunc("GET /authorize", p.authorizeHandler)
+	router.HandleFunc("POST /token", p.tokenHandler)
+
+	return router
+}
+
+func (p *provider) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                p.config.issuer,
+		"authorization_endpoint":                p.config.issuer + "/authorize",
+		"token_endpoint":                        p.config.issuer + "/token",
+		"jwks_uri":                              p.config.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+	})
+}
+
+func (p *provider) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	pub := p.key.PublicKey
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": p.keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+// Approve the authorization request and redirect back to the client with a code. Errors
+// which make the redirect URI untrustworthy are shown to the user instead, as required by
+// RFC 6749 section 4.1.2.1.
+func (p *provider) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	if qs.Get("client_id") != p.config.clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(qs.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	redirect := func(params url.Values) {
+		params.Set("state", qs.Get("state"))
+		redirectURI.RawQuery = params.Encode()
+		http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+	}
+
+	switch {
+	case qs.Get("response_type") != "code":
+		redirect(url.Values{"error": {"unsupported_response_type"}})
+		return
+	case qs.Get("code_challenge") == "" || qs.Get("code_challenge_method") != "S256":
+		redirect(url.Values{"error": {"invalid_request"}, "error_description": {"PKCE with S256 is required"}})
+		return
+	}
+
+	email := p.config.email
+	if hint := qs.Get("login_hint"); hint != "" {
+		email = hint
+	}
+
+	code := randomString(32)
+
+	p.mu.Lock()
+	p.codes[code] = &authorization{
+		redirectURI:   qs.Get("redirect_uri"),
+		codeChallenge: qs.Get("code_challenge"),
+		nonce:         qs.Get("nonce"),
+		email:         email,
+		expiry:        time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	p.logger.PrintInfo("authorized", map[string]string{"email": email})
+
+	redirect(url.Values{"code": {code}})
+}
+
+// Redeem a code for an ID token, checking the client credentials, the redirect URI and the
+// PKCE code verifier. Codes can only be used once.
+func (p *provider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.config.clientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.config.clientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+
+	switch {
+	case !ok || time.Now().After(auth.expiry):
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "invalid or expired code")
+		return
+	case r.PostForm.Get("redirect_uri") != auth.redirectURI:
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "redirect_uri mismatch")
+		return
+	case base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.codeChallenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "code_verifier mismatch")
+		return
+	}
+
+	now := time.Now()
+	idToken, err := jwt.SignRS256(map[string]any{
+		"iss":            p.config.issuer,
+		"sub":            "fake|" + auth.email,
+		"aud":            p.config.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          auth.nonce,
+		"email":          auth.email,
+		"email_verified": p.config.emailVerified,
+		"name":           p.config.name,
+	}, p.key, p.keyID)
+	if err != nil {
+		p.logger.PrintError(err, nil)
+		tokenError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": randomString(32),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func tokenError(w http.ResponseWriter, status int, code, description string) {
+	body := map[string]string{"error": code}
+	if description != "" {
+		body["error_description"] = description
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	js, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(js, '\n'))
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,176 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/igredk/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Prefix of every API key, which tells them apart from authentication tokens (and makes
+// them easy to spot for secret scanners).
+const APIKeyPrefix = "glk_"
+
+// An APIKey is a long-lived credential for scripts, which only grants the listed subset
+// of its user's permissions. The plaintext key is only known right after creation.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// IsAPIKey reports if a bearer credential looks like an API key rather than a token.
+func IsAPIKey(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APIKeyPrefix)
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// An APIKeyModel struct type which wraps a connection pool.
+type APIKeyModel struct {
+	DB *pgxpool.Pool
+}
+
+// Generate a new API key for the key's user and insert it, filling in the ID, Plaintext,
+// Hash and CreatedAt fields.
+func (m APIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	key.Plaintext = APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key.Hash = TokenHash(key.Plaintext)
+
+	query := `
+        INSERT INTO api_keys (user_id, name, hash, permissions)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Hash, key.Permissions}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRow(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+	return contextError(ctx, err)
+}
+
+func collectAPIKeys(rows pgx.Rows) ([]*APIKey, error) {
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*APIKey, error) {
+		var key APIKey
+		err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Hash, &key.Permissions, &key.CreatedAt, &key.LastUsedAt)
+		return &key, err
+	})
+}
+
+// Returns the API key with the given SHA-256 hash, or ErrRecordNotFound.
+func (m APIKeyModel) GetByHash(ctx context.Context, hash []byte) (*APIKey, error) {
+	query := `
+        SELECT id, user_id, name, hash, permissions, created_at, last_used_at
+        FROM api_keys
+        WHERE hash = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query, hash)
+
+	keys, err := collectAPIKeys(rows)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return keys[0], nil
+}
+
+// Returns the API keys of a user, newest first.
+func (m APIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	query := `
+        SELECT id, user_id, name, hash, permissions, created_at, last_used_at
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query, userID)
+
+	keys, err := collectAPIKeys(rows)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return keys, nil
+}
+
+// Record that an API key has been used. To spare a write on every request of a busy
+// script, last_used_at is only updated once a minute.
+func (m APIKeyModel) Touch(ctx context.Context, id int64) error {
+	query := `
+        UPDATE api_keys
+        SET last_used_at = NOW()
+        WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - interval '1 minute')`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, id)
+	return contextError(ctx, err)
+}
+
+// Delete an API key of a user. If the user has no key with this ID, ErrRecordNotFound is
+// returned.
+func (m APIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Delete all API keys of a user.
+func (m APIKeyModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return contextError(ctx, err)
+}
@@ -0,0 +1,64 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditPermissionsReplaced = "permissions.replaced"
+	AuditPermissionsRemoved  = "permissions.removed"
+	AuditLoginFailed         = "login.failed"
+	AuditAccountLocked       = "account.locked"
+	AuditAccountUnlocked     = "account.unlocked"
+	AuditTwoFactorEnabled    = "two_factor.enabled"
+	AuditTwoFactorDisabled   = "two_factor.disabled"
+	AuditRecoveryCodeUsed    = "two_factor.recovery_code_used"
+	AuditAPIKeyCreated       = "api_key.created"
+	AuditAPIKeyRevoked       = "api_key.revoked"
+	AuditRefreshTokenReused  = "refresh_token.reused"
+	AuditOIDCUserCreated     = "oidc.user_created"
+	AuditUserActivated       = "user.activated"
+	AuditUserDeactivated     = "user.deactivated"
+	AuditUserSuspended       = "user.suspended"
+	AuditUserUnsuspended     = "user.unsuspended"
+)
+
+// An AuditEntry records who (ActorID) did what (Action and Details) to which user
+// (UserID). Either ID may be zero if it doesn't apply, e.g. for actions taken by the
+// system itself.
+type AuditEntry struct {
+	ID        int64          `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	ActorID   int64          `json:"actor_id,omitempty"`
+	UserID    int64          `json:"user_id,omitempty"`
+	Action    string         `json:"action"`
+	Details   map[string]any `json:"details"`
+}
+
+// An AuditModel struct type which wraps a connection pool.
+type AuditModel struct {
+	DB *pgxpool.Pool
+}
+
+func (m AuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	query := `
+        INSERT INTO audit_log (actor_id, user_id, action, details)
+        VALUES (NULLIF($1::bigint, 0), NULLIF($2::bigint, 0), $3, $4)
+        RETURNING id, created_at`
+
+	if entry.Details == nil {
+		entry.Details = map[string]any{}
+	}
+
+	args := []any{entry.ActorID, entry.UserID, entry.Action, entry.Details}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&entry.ID, &entry.CreatedAt)
+	return contextError(ctx, err)
+}
@@ -0,0 +1,178 @@
+package data
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A userCache holds a value per user for recently seen users, evicting the least
+// recently used entry once it's full. Entries also expire after a fixed TTL, which
+// bounds how long a missed invalidation can go unnoticed. Invalidations are announced
+// by database triggers on a PostgreSQL channel, with the ID of the affected user as
+// payload, or an empty payload if any number of users may be affected.
+type userCache[V any] struct {
+	size    int
+	ttl     time.Duration
+	channel string
+
+	mu      sync.Mutex
+	entries map[int64]*list.Element
+	lru     *list.List // most recently used at the front
+	// Incremented on every invalidation, so that a lookup which raced with an
+	// invalidation doesn't put a stale value into the cache.
+	generation uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type userCacheEntry[V any] struct {
+	userID int64
+	value  V
+	expiry time.Time
+}
+
+func newUserCache[V any](size int, ttl time.Duration, channel string) *userCache[V] {
+	return &userCache[V]{
+		size:    size,
+		ttl:     ttl,
+		channel: channel,
+		entries: make(map[int64]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Return the cached value for a user along with the current generation, which must be
+// passed to put() when filling the cache after a miss.
+func (c *userCache[V]) get(userID int64) (V, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[userID]; ok {
+		entry := element.Value.(*userCacheEntry[V])
+		if time.Now().Before(entry.expiry) {
+			c.lru.MoveToFront(element)
+			c.hits.Add(1)
+			return entry.value, c.generation, true
+		}
+		c.remove(element)
+	}
+
+	c.misses.Add(1)
+	var zero V
+	return zero, c.generation, false
+}
+
+func (c *userCache[V]) put(userID int64, value V, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if element, ok := c.entries[userID]; ok {
+		c.remove(element)
+	}
+
+	c.entries[userID] = c.lru.PushFront(&userCacheEntry[V]{
+		userID: userID,
+		value:  value,
+		expiry: time.Now().Add(c.ttl),
+	})
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// The caller must hold the mutex.
+func (c *userCache[V]) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*userCacheEntry[V]).userID)
+}
+
+// Invalidate drops the cached value of a single user.
+func (c *userCache[V]) Invalidate(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if element, ok := c.entries[userID]; ok {
+		c.remove(element)
+	}
+}
+
+// Purge drops the cached values of all users.
+func (c *userCache[V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	clear(c.entries)
+	c.lru.Init()
+}
+
+// Stats returns the hit and miss counters and the current number of entries.
+func (c *userCache[V]) Stats() map[string]int64 {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return map[string]int64{
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+		"entries": int64(size),
+	}
+}
+
+// Channel returns the name of the PostgreSQL channel Listen() subscribes to.
+func (c *userCache[V]) Channel() string {
+	return c.channel
+}
+
+// Listen invalidates cache entries as changes are announced on the cache's channel,
+// which lets replicas see changes made through any other replica (or by hand). It
+// blocks until ctx is canceled or the connection fails, and always returns a non-nil
+// error.
+func (c *userCache[V]) Listen(ctx context.Context, db *pgxpool.Pool) error {
+	poolConn, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// Take the connection out of the pool and close it when we're done, so that a
+	// connection which is still subscribed to the channel is never reused.
+	conn := poolConn.Hijack()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		conn.Close(ctx)
+	}()
+
+	_, err = conn.Exec(ctx, "LISTEN "+c.channel)
+	if err != nil {
+		return err
+	}
+	// Changes made while we weren't listening have been missed, so start over.
+	c.Purge()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		userID, err := strconv.ParseInt(notification.Payload, 10, 64)
+		if err != nil {
+			c.Purge()
+			continue
+		}
+		c.Invalidate(userID)
+	}
+}
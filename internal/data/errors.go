@@ -4,6 +4,7 @@ import "errors"
 
 const (
 	UniqueConstraintViolation = "23505"
+	ForeignKeyViolation       = "23503"
 )
 
 var (
@@ -1,25 +1,39 @@
 package data
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"slices"
 	"strings"
 
 	"github.com/igredk/greenlight/internal/validator"
 )
 
+// Returned when a client-provided cursor can't be used for the current query.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	// Opaque cursor returned in a previous Metadata. When set, keyset pagination is used
+	// and Page is ignored.
+	Cursor string
 }
 
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -67,10 +81,162 @@ func (f Filters) sortDirection() string {
 	return "ASC"
 }
 
+// A cursor identifies the row a keyset page starts after (or, when Before is set, ends
+// before). It holds the value of the sort column and the id of that row, because id is
+// always the tiebreaker in the ORDER BY clause. The sort parameter is included so that a
+// cursor can't be reused with a different sort order.
+type cursor struct {
+	Sort   string `json:"s"`
+	Value  any    `json:"v"`
+	ID     int64  `json:"id"`
+	Before bool   `json:"b,omitempty"`
+}
+
+func (c cursor) encode() string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		// The cursor only ever holds strings and integers, so this can't happen.
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// Decode the Cursor field. Numeric sort values are returned as int64, text values as string.
+func (f Filters) decodeCursor() (cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(f.Cursor)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	var c cursor
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	if err := dec.Decode(&c); err != nil || c.Sort != f.Sort {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	switch value := c.Value.(type) {
+	case json.Number:
+		i, err := value.Int64()
+		if err != nil {
+			return cursor{}, ErrInvalidCursor
+		}
+		c.Value = i
+	case string:
+	default:
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// Return the WHERE condition and ORDER BY clause for fetching the page following (or,
+// for a Before cursor, preceding) the cursor position. valueArg and idArg are the
+// placeholders holding the cursor's sort value and id. Rows are always ordered by id
+// ascending within equal sort values, so a backwards page is fetched in the exact
+// reverse order and must be reversed again by the caller.
+func (f Filters) keysetClauses(c cursor, valueArg, idArg string) (where, orderBy string) {
+	column, direction := f.sortColumn(), f.sortDirection()
+
+	after, idAfter := ">", ">"
+	if direction == "DESC" {
+		after = "<"
+	}
+	orderDirection, idDirection := direction, "ASC"
+
+	if c.Before {
+		after, idAfter = flipComparison(after), flipComparison(idAfter)
+		orderDirection, idDirection = flipDirection(orderDirection), flipDirection(idDirection)
+	}
+
+	where = fmt.Sprintf("(%[1]s %[2]s %[3]s OR (%[1]s = %[3]s AND id %[4]s %[5]s))", column, after, valueArg, idAfter, idArg)
+	orderBy = fmt.Sprintf("%s %s, id %s", column, orderDirection, idDirection)
+
+	return where, orderBy
+}
+
+func flipComparison(op string) string {
+	if op == ">" {
+		return "<"
+	}
+	return ">"
+}
+
+func flipDirection(direction string) string {
+	if direction == "ASC" {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+// Drop the extra row fetched to detect whether more rows exist beyond the page, and
+// put the rows of a backwards page back into display order.
+func trimKeysetPage[T any](rows []T, limit int, before bool) ([]T, bool) {
+	hasMore := len(rows) > limit
+	if hasMore {
+		rows = rows[:limit]
+	}
+
+	if before {
+		slices.Reverse(rows)
+	}
+
+	return rows, hasMore
+}
+
+// The sort column value and id of a row, used to build the cursors pointing at it.
+type cursorKey struct {
+	value any
+	id    int64
+}
+
+// Build the metadata for a keyset page. first and last are the keys of the first and
+// last rows of the page in display order (nil for an empty page), and hasMore reports
+// whether more rows exist beyond the page in the direction it was fetched.
+func keysetMetadata(f Filters, c cursor, first, last *cursorKey, hasMore bool) Metadata {
+	metadata := Metadata{PageSize: f.PageSize}
+
+	if first == nil {
+		return metadata
+	}
+	// Moving forwards, there's always a previous page (the cursor row itself came
+	// before this one), and there's a next page only if we found extra rows. Moving
+	// backwards it's the other way round.
+	if !c.Before || hasMore {
+		metadata.PrevCursor = cursor{Sort: f.Sort, Value: first.value, ID: first.id, Before: true}.encode()
+	}
+	if c.Before || hasMore {
+		metadata.NextCursor = cursor{Sort: f.Sort, Value: last.value, ID: last.id}.encode()
+	}
+
+	return metadata
+}
+
+// Add cursors to the metadata of a page-based result, so that clients can switch to
+// keyset pagination from any page.
+func (m *Metadata) addCursors(f Filters, first, last *cursorKey) {
+	if first == nil {
+		return
+	}
+
+	if m.CurrentPage > 1 {
+		m.PrevCursor = cursor{Sort: f.Sort, Value: first.value, ID: first.id, Before: true}.encode()
+	}
+	if m.CurrentPage < m.LastPage {
+		m.NextCursor = cursor{Sort: f.Sort, Value: last.value, ID: last.id}.encode()
+	}
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.Page > 0, "page", "must be greater than zero")
 	v.Check(f.Page <= 1_000_000, "page", "must be a maximum of 1 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+
+	if f.Cursor != "" && v.Valid() {
+		_, err := f.decodeCursor()
+		v.Check(err == nil, "cursor", "invalid cursor value")
+	}
 }
@@ -0,0 +1,123 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// LoginAttempts holds the consecutive failed logins for an email address, when the last
+// of them happened, and until when logins with it are locked (the zero time if they
+// aren't).
+type LoginAttempts struct {
+	Email         string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// Locked reports if logins are locked at time t.
+func (a *LoginAttempts) Locked(t time.Time) bool {
+	return a.LockedUntil.After(t)
+}
+
+// A LoginAttemptModel struct type which wraps a connection pool.
+type LoginAttemptModel struct {
+	DB *pgxpool.Pool
+}
+
+// Return the failed logins for an email address. Addresses without any failed logins
+// get a zero LoginAttempts rather than an error.
+func (m LoginAttemptModel) Get(ctx context.Context, email string) (*LoginAttempts, error) {
+	query := `
+        SELECT email, failures, last_failure_at, locked_until
+        FROM login_attempts
+        WHERE email = $1`
+
+	var (
+		attempts    = LoginAttempts{Email: email}
+		lockedUntil *time.Time
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, email).Scan(&attempts.Email, &attempts.Failures, &attempts.LastFailureAt, &lockedUntil)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, contextError(ctx, err)
+	}
+
+	if lockedUntil != nil {
+		attempts.LockedUntil = *lockedUntil
+	}
+
+	return &attempts, nil
+}
+
+// Count a failed login for an email address, returning the number of consecutive
+// failures including this one. If the previous failure is older than window, counting
+// starts over, so that occasional typos spread over months never lock an account. Rows
+// which would start over like that and aren't locked are deleted at the same time, as
+// addresses without an account never have a successful login which resets them.
+func (m LoginAttemptModel) RecordFailure(ctx context.Context, email string, window time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, `
+        DELETE FROM login_attempts
+        WHERE last_failure_at < NOW() - make_interval(secs => $1)
+        AND (locked_until IS NULL OR locked_until < NOW())`, window.Seconds())
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	query := `
+        INSERT INTO login_attempts (email, failures)
+        VALUES ($1, 1)
+        ON CONFLICT (email) DO UPDATE
+        SET failures = CASE
+                WHEN login_attempts.last_failure_at < NOW() - make_interval(secs => $2) THEN 1
+                ELSE login_attempts.failures + 1
+            END,
+            last_failure_at = NOW()
+        RETURNING failures`
+
+	var failures int
+	err = m.DB.QueryRow(ctx, query, email, window.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, contextError(ctx, err)
+	}
+
+	return failures, nil
+}
+
+// Lock logins with an email address until the given time.
+func (m LoginAttemptModel) Lock(ctx context.Context, email string, until time.Time) error {
+	query := `
+        UPDATE login_attempts
+        SET locked_until = $2
+        WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, email, until)
+	return contextError(ctx, err)
+}
+
+// Forget the failed logins for an email address, which also lifts any lock. This is
+// done after a successful login and when a user unlocks their account.
+func (m LoginAttemptModel) Reset(ctx context.Context, email string) error {
+	query := `
+        DELETE FROM login_attempts
+        WHERE email = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, email)
+	return contextError(ctx, err)
+}
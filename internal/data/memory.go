@@ -0,0 +1,1687 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// The memoryStore holds all records of the in-memory data layer. It mirrors the tables
+// of the PostgreSQL schema, and a single mutex guards all of them so that operations
+// spanning several "tables" (like looking up the user for a token) are consistent.
+type memoryStore struct {
+	mu sync.Mutex
+
+	movies          map[int64]*Movie
+	lastMovieID     int64
+	users           map[int64]*User
+	lastUserID      int64
+	tokens          []*Token
+	lastTokenID     int64
+	permissions     map[string]bool
+	userPermissions map[int64]map[string]bool
+	roles           map[int64]*Role
+	lastRoleID      int64
+	userRoles       map[int64]map[int64]bool
+	auditLog        []*AuditEntry
+	lastAuditID     int64
+	outbox          map[int64]*memoryEmail
+	lastEmailID     int64
+	loginAttempts   map[string]*LoginAttempts // keyed by lowercased email
+	twoFactor       map[int64]*TwoFactor
+	recoveryCodes   map[int64][][]byte
+	apiKeys         map[int64]*APIKey
+	lastAPIKeyID    int64
+	oidcLogins      map[string]*OIDCLogin // keyed by state hash
+}
+
+// NewMemoryModels returns a Models struct backed by an in-memory store. Nothing is
+// persisted, which makes it handy for local demos and for testing handlers without a
+// running PostgreSQL server.
+func NewMemoryModels() Models {
+	store := &memoryStore{
+		movies:          make(map[int64]*Movie),
+		users:           make(map[int64]*User),
+		userPermissions: make(map[int64]map[string]bool),
+		roles:           make(map[int64]*Role),
+		userRoles:       make(map[int64]map[int64]bool),
+		outbox:          make(map[int64]*memoryEmail),
+		loginAttempts:   make(map[string]*LoginAttempts),
+		twoFactor:       make(map[int64]*TwoFactor),
+		recoveryCodes:   make(map[int64][][]byte),
+		apiKeys:         make(map[int64]*APIKey),
+		oidcLogins:      make(map[string]*OIDCLogin),
+		// The same permission codes and roles which are inserted by the migrations.
+		permissions: map[string]bool{
+			"movies:read":  true,
+			"movies:write": true,
+			"users:admin":  true,
+		},
+	}
+
+	for _, role := range []*Role{
+		{Name: "viewer", Permissions: Permissions{"movies:read"}},
+		{Name: "editor", Permissions: Permissions{"movies:read", "movies:write"}},
+		{Name: "admin", Permissions: Permissions{"movies:read", "movies:write", "users:admin"}},
+	} {
+		store.lastRoleID++
+		role.ID = store.lastRoleID
+		store.roles[role.ID] = role
+	}
+
+	return Models{
+		Movies:        memoryMovieModel{store: store},
+		Users:         memoryUserModel{store: store},
+		Tokens:        memoryTokenModel{store: store},
+		Permissions:   memoryPermissionModel{store: store},
+		Roles:         memoryRoleModel{store: store},
+		Audit:         memoryAuditModel{store: store},
+		Outbox:        memoryOutboxModel{store: store},
+		LoginAttempts: memoryLoginAttemptModel{store: store},
+		TwoFactor:     memoryTwoFactorModel{store: store},
+		APIKeys:       memoryAPIKeyModel{store: store},
+		OIDCLogins:    memoryOIDCLoginModel{store: store},
+	}
+}
+
+// Reports an error if the context is already done, in the same way the PostgreSQL
+// models do when a query is aborted.
+func checkContext(ctx context.Context) error {
+	return contextError(ctx, ctx.Err())
+}
+
+type memoryMovieModel struct {
+	store *memoryStore
+}
+
+// Split a string into lowercase words, approximating to_tsvector('simple', ...).
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Reports whether a movie matches the title and genres filters in the same way as the
+// WHERE clause in MovieModel.GetAll().
+func movieMatches(movie *Movie, title string, genres []string) bool {
+	if title != "" {
+		words := searchWords(movie.Title)
+		for _, word := range searchWords(title) {
+			if !slices.Contains(words, word) {
+				return false
+			}
+		}
+	}
+
+	for _, genre := range genres {
+		if !slices.Contains(movie.Genres, genre) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Compare two movies on the given sort column, returning a negative number, zero or a
+// positive number like strings.Compare() does.
+func compareMovies(a, b *Movie, column string) int {
+	switch column {
+	case "title":
+		return strings.Compare(a.Title, b.Title)
+	case "year":
+		return int(a.Year) - int(b.Year)
+	case "runtime":
+		return int(a.Runtime) - int(b.Runtime)
+	default:
+		return compareIDs(a.ID, b.ID)
+	}
+}
+
+func compareIDs(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func copyMovie(movie *Movie) *Movie {
+	c := *movie
+	c.Genres = slices.Clone(movie.Genres)
+	return &c
+}
+
+func (m memoryMovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	column, direction := filters.sortColumn(), filters.sortDirection()
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	// Compare two movies in display order: by the sort column in the requested
+	// direction, then by ascending ID.
+	compare := func(a, b *Movie) int {
+		c := compareMovies(a, b, column)
+		if direction == "DESC" {
+			c = -c
+		}
+		if c == 0 {
+			return compareIDs(a.ID, b.ID)
+		}
+		return c
+	}
+
+	matched := []*Movie{}
+	for _, movie := range m.store.movies {
+		if movieMatches(movie, title, genres) {
+			matched = append(matched, movie)
+		}
+	}
+	slices.SortFunc(matched, compare)
+
+	if filters.Cursor != "" {
+		return memoryMoviesFromCursor(matched, filters, compare)
+	}
+
+	totalRecords := len(matched)
+
+	movies := []*Movie{}
+	for i := filters.offset(); i < totalRecords && len(movies) < filters.limit(); i++ {
+		movies = append(movies, copyMovie(matched[i]))
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	first, last := movieCursorKeys(movies, column)
+	metadata.addCursors(filters, first, last)
+
+	return movies, metadata, nil
+}
+
+// Return the keyset page following (or preceding) the cursor position from a slice of
+// movies which is already sorted in display order.
+func memoryMoviesFromCursor(sorted []*Movie, filters Filters, compare func(a, b *Movie) int) ([]*Movie, Metadata, error) {
+	column := filters.sortColumn()
+
+	c, err := filters.decodeCursor()
+	if err != nil || !validMovieCursor(column, c) {
+		return nil, Metadata{}, ErrInvalidCursor
+	}
+	// Build a movie holding the cursor's key, so it can be compared with the others.
+	probe := &Movie{ID: c.ID}
+	switch column {
+	case "title":
+		probe.Title = c.Value.(string)
+	case "year":
+		probe.Year = int32(c.Value.(int64))
+	case "runtime":
+		probe.Runtime = Runtime(c.Value.(int64))
+	}
+
+	page := []*Movie{}
+	for _, movie := range sorted {
+		if (c.Before && compare(movie, probe) < 0) || (!c.Before && compare(movie, probe) > 0) {
+			page = append(page, movie)
+		}
+	}
+	// Moving backwards, the page consists of the rows right before the cursor.
+	hasMore := len(page) > filters.limit()
+	if hasMore && c.Before {
+		page = page[len(page)-filters.limit():]
+	} else if hasMore {
+		page = page[:filters.limit()]
+	}
+
+	movies := []*Movie{}
+	for _, movie := range page {
+		movies = append(movies, copyMovie(movie))
+	}
+
+	first, last := movieCursorKeys(movies, column)
+
+	return movies, keysetMetadata(filters, c, first, last, hasMore), nil
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.lastMovieID++
+	movie.ID = m.store.lastMovieID
+	movie.CreatedAt = time.Now().Truncate(time.Second)
+	movie.Version = 1
+
+	m.store.movies[movie.ID] = copyMovie(movie)
+
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	movie, ok := m.store.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyMovie(movie), nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	// Only update the record if it still has the version the caller read.
+	stored, ok := m.store.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	movie.Version++
+	m.store.movies[movie.ID] = copyMovie(movie)
+
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, id int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.movies[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(m.store.movies, id)
+
+	return nil
+}
+
+type memoryUserModel struct {
+	store *memoryStore
+}
+
+func copyUser(user *User) *User {
+	c := *user
+	c.Password.plaintext = nil
+	c.Password.hash = bytes.Clone(user.Password.hash)
+	return &c
+}
+
+// Returns the user with the given email address, comparing case-insensitively like
+// the citext column does. The caller must hold the store mutex.
+func (s *memoryStore) userByEmail(email string) *User {
+	for _, user := range s.users {
+		if strings.EqualFold(user.Email, email) {
+			return user
+		}
+	}
+	return nil
+}
+
+// Reports whether a user matches the filters in the same way as the WHERE clause in
+// UserModel.GetAll().
+func userMatches(user *User, email, name string, activated *bool) bool {
+	return strings.Contains(strings.ToLower(user.Email), strings.ToLower(email)) &&
+		strings.Contains(strings.ToLower(user.Name), strings.ToLower(name)) &&
+		(activated == nil || user.Activated == *activated)
+}
+
+// Compare two users by a sort column. Emails are compared case-insensitively, like the
+// citext column.
+func compareUsers(a, b *User, column string) int {
+	switch column {
+	case "name":
+		return strings.Compare(a.Name, b.Name)
+	case "email":
+		return strings.Compare(strings.ToLower(a.Email), strings.ToLower(b.Email))
+	default:
+		return compareIDs(a.ID, b.ID)
+	}
+}
+
+func (m memoryUserModel) GetAll(ctx context.Context, email, name string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	column, direction := filters.sortColumn(), filters.sortDirection()
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	// Compare two users in display order: by the sort column in the requested
+	// direction, then by ascending ID.
+	compare := func(a, b *User) int {
+		c := compareUsers(a, b, column)
+		if direction == "DESC" {
+			c = -c
+		}
+		if c == 0 {
+			return compareIDs(a.ID, b.ID)
+		}
+		return c
+	}
+
+	matched := []*User{}
+	for _, user := range m.store.users {
+		if userMatches(user, email, name, activated) {
+			matched = append(matched, user)
+		}
+	}
+	slices.SortFunc(matched, compare)
+
+	if filters.Cursor != "" {
+		return memoryUsersFromCursor(matched, filters, compare)
+	}
+
+	totalRecords := len(matched)
+
+	users := []*User{}
+	for i := filters.offset(); i < totalRecords && len(users) < filters.limit(); i++ {
+		users = append(users, copyUser(matched[i]))
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	first, last := userCursorKeys(users, column)
+	metadata.addCursors(filters, first, last)
+
+	return users, metadata, nil
+}
+
+// Return the keyset page following (or preceding) the cursor position from a slice of
+// users which is already sorted in display order.
+func memoryUsersFromCursor(sorted []*User, filters Filters, compare func(a, b *User) int) ([]*User, Metadata, error) {
+	column := filters.sortColumn()
+
+	c, err := filters.decodeCursor()
+	if err != nil || !validUserCursor(column, c) {
+		return nil, Metadata{}, ErrInvalidCursor
+	}
+	// Build a user holding the cursor's key, so it can be compared with the others.
+	probe := &User{ID: c.ID}
+	switch column {
+	case "name":
+		probe.Name = c.Value.(string)
+	case "email":
+		probe.Email = c.Value.(string)
+	}
+
+	page := []*User{}
+	for _, user := range sorted {
+		if (c.Before && compare(user, probe) < 0) || (!c.Before && compare(user, probe) > 0) {
+			page = append(page, user)
+		}
+	}
+	// Moving backwards, the page consists of the rows right before the cursor.
+	hasMore := len(page) > filters.limit()
+	if hasMore && c.Before {
+		page = page[len(page)-filters.limit():]
+	} else if hasMore {
+		page = page[:filters.limit()]
+	}
+
+	users := []*User{}
+	for _, user := range page {
+		users = append(users, copyUser(user))
+	}
+
+	first, last := userCursorKeys(users, column)
+
+	return users, keysetMetadata(filters, c, first, last, hasMore), nil
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if m.store.userByEmail(user.Email) != nil {
+		return ErrDuplicateEmail
+	}
+
+	m.store.lastUserID++
+	user.ID = m.store.lastUserID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Version = 1
+
+	m.store.users[user.ID] = copyUser(user)
+
+	return nil
+}
+
+func (m memoryUserModel) InsertWithRole(ctx context.Context, user *User, roleName string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if m.store.userByEmail(user.Email) != nil {
+		return ErrDuplicateEmail
+	}
+
+	var roleID int64
+	for _, role := range m.store.roles {
+		if role.Name == roleName {
+			roleID = role.ID
+		}
+	}
+	if roleID == 0 {
+		return ErrRecordNotFound
+	}
+
+	m.store.lastUserID++
+	user.ID = m.store.lastUserID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Version = 1
+
+	m.store.users[user.ID] = copyUser(user)
+	m.store.userRoles[user.ID] = map[int64]bool{roleID: true}
+
+	return nil
+}
+
+func (m memoryUserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	user, ok := m.store.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+func (m memoryUserModel) GetStatus(ctx context.Context, id int64) (*UserStatus, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	user, ok := m.store.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return &UserStatus{Activated: user.Activated, Suspended: user.Suspended}, nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	user := m.store.userByEmail(email)
+	if user == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if other := m.store.userByEmail(user.Email); other != nil && other.ID != user.ID {
+		return ErrDuplicateEmail
+	}
+
+	stored, ok := m.store.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	user.Version++
+	m.store.users[user.ID] = copyUser(user)
+
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	tokenHash := TokenHash(tokenPlaintext)
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, token := range m.store.tokens {
+		if bytes.Equal(token.Hash, tokenHash) && token.Scope == tokenScope && token.Expiry.After(time.Now()) {
+			if user, ok := m.store.users[token.UserID]; ok {
+				return copyUser(user), nil
+			}
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+type memoryTokenModel struct {
+	store *memoryStore
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.lastTokenID++
+	token.ID = m.store.lastTokenID
+
+	c := *token
+	c.Plaintext = ""
+	// The tokens table stores times with a precision of one second.
+	c.Expiry = token.Expiry.Truncate(time.Second)
+	c.CreatedAt = token.CreatedAt.Truncate(time.Second)
+	if token.LastUsedAt != nil {
+		lastUsedAt := token.LastUsedAt.Truncate(time.Second)
+		c.LastUsedAt = &lastUsedAt
+	}
+	m.store.tokens = append(m.store.tokens, &c)
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(t *Token) bool {
+		return t.Scope == scope && t.UserID == userID
+	})
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllScopesForUser(ctx context.Context, userID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(t *Token) bool {
+		return t.UserID == userID
+	})
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, keepHash []byte) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(t *Token) bool {
+		return t.Scope == scope && t.UserID == userID && !bytes.Equal(t.Hash, keepHash)
+	})
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteByHash(ctx context.Context, hash []byte) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	n := len(m.store.tokens)
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(t *Token) bool {
+		return bytes.Equal(t.Hash, hash)
+	})
+
+	if len(m.store.tokens) == n {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m memoryTokenModel) NewSession(ctx context.Context, userID int64, ttl time.Duration, client Client) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.Client = client
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, client Client, previous *Token) (*Token, error) {
+	token, err := generateRefreshToken(userID, ttl, client, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) UseRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	tokenHash := TokenHash(tokenPlaintext)
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, token := range m.store.tokens {
+		if bytes.Equal(token.Hash, tokenHash) && token.Scope == ScopeRefresh && token.Expiry.After(time.Now()) {
+			c := *token
+			if token.Used {
+				return &c, ErrTokenReused
+			}
+			token.Used = true
+			return &c, nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryTokenModel) DeleteFamily(ctx context.Context, family string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(t *Token) bool {
+		return t.Family != "" && t.Family == family
+	})
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUserExceptFamily(ctx context.Context, scope string, userID int64, keepFamily string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(t *Token) bool {
+		return t.Scope == scope && t.UserID == userID && (t.Family == "" || t.Family != keepFamily)
+	})
+
+	return nil
+}
+
+func (m memoryTokenModel) GetSessionsForUser(ctx context.Context, userID int64) ([]*Session, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	sessions := []*Session{}
+	for _, token := range m.store.tokens {
+		if token.UserID != userID || !token.Expiry.After(time.Now()) {
+			continue
+		}
+		if token.Scope != ScopeAuthentication && (token.Scope != ScopeRefresh || token.Used) {
+			continue
+		}
+
+		session := &Session{
+			ID:        token.ID,
+			CreatedAt: token.CreatedAt,
+			Expiry:    token.Expiry,
+			IP:        token.Client.IP,
+			UserAgent: token.Client.UserAgent,
+			Hash:      token.Hash,
+			Family:    token.Family,
+		}
+		if token.LastUsedAt != nil {
+			lastUsedAt := *token.LastUsedAt
+			session.LastUsedAt = &lastUsedAt
+		}
+		sessions = append(sessions, session)
+	}
+
+	lastActive := func(s *Session) time.Time {
+		if s.LastUsedAt != nil {
+			return *s.LastUsedAt
+		}
+		return s.CreatedAt
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		if c := lastActive(b).Compare(lastActive(a)); c != 0 {
+			return c
+		}
+		return compareIDs(b.ID, a.ID)
+	})
+
+	return sessions, nil
+}
+
+func (m memoryTokenModel) DeleteSession(ctx context.Context, id, userID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	var family string
+	for _, token := range m.store.tokens {
+		if token.ID == id && token.UserID == userID && token.Scope == ScopeRefresh && !token.Used {
+			family = token.Family
+		}
+	}
+
+	n := len(m.store.tokens)
+	m.store.tokens = slices.DeleteFunc(m.store.tokens, func(t *Token) bool {
+		if t.UserID != userID {
+			return false
+		}
+		return (t.ID == id && t.Scope == ScopeAuthentication) || (family != "" && t.Family == family)
+	})
+
+	if len(m.store.tokens) == n {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m memoryTokenModel) Touch(ctx context.Context, hash []byte) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	now := time.Now().Truncate(time.Second)
+	for _, token := range m.store.tokens {
+		if bytes.Equal(token.Hash, hash) && (token.LastUsedAt == nil || token.LastUsedAt.Before(now.Add(-time.Minute))) {
+			token.LastUsedAt = &now
+		}
+	}
+
+	return nil
+}
+
+type memoryPermissionModel struct {
+	store *memoryStore
+}
+
+func (m memoryPermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	permissions := Permissions{}
+	for code := range m.store.permissions {
+		permissions = append(permissions, code)
+	}
+	slices.Sort(permissions)
+
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	// Collect the union of the direct permissions and those of the user's roles.
+	codes := make(map[string]bool)
+	for code := range m.store.userPermissions[userID] {
+		codes[code] = true
+	}
+	for roleID := range m.store.userRoles[userID] {
+		for _, code := range m.store.roles[roleID].Permissions {
+			codes[code] = true
+		}
+	}
+
+	permissions := Permissions{}
+	for code := range codes {
+		permissions = append(permissions, code)
+	}
+	slices.Sort(permissions)
+
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if _, ok := m.store.userPermissions[userID]; !ok {
+		m.store.userPermissions[userID] = make(map[string]bool)
+	}
+	// Like the INSERT ... SELECT query, codes which don't exist are silently skipped.
+	for _, code := range codes {
+		if m.store.permissions[code] {
+			m.store.userPermissions[userID][code] = true
+		}
+	}
+
+	return nil
+}
+
+func (m memoryPermissionModel) GetDirectForUser(ctx context.Context, userID int64) (Permissions, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	permissions := Permissions{}
+	for code := range m.store.userPermissions[userID] {
+		permissions = append(permissions, code)
+	}
+	slices.Sort(permissions)
+
+	return permissions, nil
+}
+
+func (m memoryPermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, code := range codes {
+		delete(m.store.userPermissions[userID], code)
+	}
+
+	return nil
+}
+
+func (m memoryPermissionModel) ReplaceForUser(ctx context.Context, userID int64, codes ...string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.userPermissions[userID] = make(map[string]bool)
+	for _, code := range codes {
+		if m.store.permissions[code] {
+			m.store.userPermissions[userID][code] = true
+		}
+	}
+
+	return nil
+}
+
+type memoryRoleModel struct {
+	store *memoryStore
+}
+
+func copyRole(role *Role) *Role {
+	c := *role
+	c.Permissions = slices.Clone(role.Permissions)
+	return &c
+}
+
+// Return copies of the given roles ordered by name.
+func sortedRoles(roles []*Role) []*Role {
+	copies := []*Role{}
+	for _, role := range roles {
+		copies = append(copies, copyRole(role))
+	}
+	slices.SortFunc(copies, func(a, b *Role) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return copies
+}
+
+func (m memoryRoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	roles := []*Role{}
+	for _, role := range m.store.roles {
+		roles = append(roles, role)
+	}
+
+	return sortedRoles(roles), nil
+}
+
+func (m memoryRoleModel) GetByName(ctx context.Context, name string) (*Role, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, role := range m.store.roles {
+		if role.Name == name {
+			return copyRole(role), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryRoleModel) GetAllForUser(ctx context.Context, userID int64) ([]*Role, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	roles := []*Role{}
+	for roleID := range m.store.userRoles[userID] {
+		roles = append(roles, m.store.roles[roleID])
+	}
+
+	return sortedRoles(roles), nil
+}
+
+// Add permission codes to a stored role, skipping unknown codes and ones the role
+// already has. The caller must hold the store mutex.
+func (s *memoryStore) addRolePermissions(role *Role, codes []string) {
+	for _, code := range codes {
+		if s.permissions[code] && !role.Permissions.Include(code) {
+			role.Permissions = append(role.Permissions, code)
+		}
+	}
+	slices.Sort(role.Permissions)
+}
+
+func (m memoryRoleModel) Insert(ctx context.Context, role *Role) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, other := range m.store.roles {
+		if other.Name == role.Name {
+			return ErrDuplicateRole
+		}
+	}
+
+	m.store.lastRoleID++
+	role.ID = m.store.lastRoleID
+
+	stored := &Role{ID: role.ID, Name: role.Name, Permissions: Permissions{}}
+	m.store.addRolePermissions(stored, role.Permissions)
+	m.store.roles[role.ID] = stored
+
+	return nil
+}
+
+func (m memoryRoleModel) AddPermissions(ctx context.Context, roleID int64, codes ...string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if role, ok := m.store.roles[roleID]; ok {
+		m.store.addRolePermissions(role, codes)
+	}
+
+	return nil
+}
+
+func (m memoryRoleModel) AssignToUser(ctx context.Context, userID, roleID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	// Mirror the foreign key constraints of the users_roles table.
+	if _, ok := m.store.users[userID]; !ok {
+		return ErrRecordNotFound
+	}
+	if _, ok := m.store.roles[roleID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	if _, ok := m.store.userRoles[userID]; !ok {
+		m.store.userRoles[userID] = make(map[int64]bool)
+	}
+	m.store.userRoles[userID][roleID] = true
+
+	return nil
+}
+
+func (m memoryRoleModel) UnassignFromUser(ctx context.Context, userID, roleID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if !m.store.userRoles[userID][roleID] {
+		return ErrRecordNotFound
+	}
+
+	delete(m.store.userRoles[userID], roleID)
+
+	return nil
+}
+
+type memoryAuditModel struct {
+	store *memoryStore
+}
+
+func (m memoryAuditModel) Insert(ctx context.Context, entry *AuditEntry) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if entry.Details == nil {
+		entry.Details = map[string]any{}
+	}
+
+	m.store.lastAuditID++
+	entry.ID = m.store.lastAuditID
+	entry.CreatedAt = time.Now().Truncate(time.Second)
+
+	c := *entry
+	m.store.auditLog = append(m.store.auditLog, &c)
+
+	return nil
+}
+
+// Emails are stored with their data encoded as JSON, like in the jsonb column, so that
+// claimed emails come back with the same types as from PostgreSQL.
+type memoryEmail struct {
+	Email
+	data []byte
+}
+
+type memoryOutboxModel struct {
+	store *memoryStore
+}
+
+func (m memoryOutboxModel) Enqueue(ctx context.Context, email *Email) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	if email.Data == nil {
+		email.Data = map[string]any{}
+	}
+
+	js, err := json.Marshal(email.Data)
+	if err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.lastEmailID++
+	email.ID = m.store.lastEmailID
+	email.CreatedAt = time.Now().Truncate(time.Second)
+	email.Status = EmailPending
+	email.NextAttemptAt = email.CreatedAt
+
+	m.store.outbox[email.ID] = &memoryEmail{Email: *email, data: js}
+
+	return nil
+}
+
+func (m memoryOutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*Email, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	now := time.Now()
+
+	var due []*memoryEmail
+	for _, email := range m.store.outbox {
+		if email.Status == EmailPending && !email.NextAttemptAt.After(now) {
+			due = append(due, email)
+		}
+	}
+	slices.SortFunc(due, func(a, b *memoryEmail) int {
+		if c := a.NextAttemptAt.Compare(b.NextAttemptAt); c != 0 {
+			return c
+		}
+		return compareIDs(a.ID, b.ID)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	emails := []*Email{}
+	for _, stored := range due {
+		stored.Attempts++
+		stored.NextAttemptAt = now.Add(lease)
+
+		email := stored.Email
+		data, err := decodeEmailData(stored.data)
+		if err != nil {
+			return nil, err
+		}
+		email.Data = data
+		emails = append(emails, &email)
+	}
+
+	return emails, nil
+}
+
+func (m memoryOutboxModel) MarkSent(ctx context.Context, id int64) error {
+	return m.update(ctx, id, func(email *memoryEmail) {
+		email.Status = EmailSent
+		email.LastError = ""
+		email.data = []byte("{}")
+	})
+}
+
+func (m memoryOutboxModel) MarkFailed(ctx context.Context, id int64, lastError string, retryAt time.Time) error {
+	return m.update(ctx, id, func(email *memoryEmail) {
+		email.LastError = lastError
+		email.NextAttemptAt = retryAt
+	})
+}
+
+func (m memoryOutboxModel) MarkDead(ctx context.Context, id int64, lastError string) error {
+	return m.update(ctx, id, func(email *memoryEmail) {
+		email.Status = EmailDead
+		email.LastError = lastError
+		email.data = []byte("{}")
+	})
+}
+
+func (m memoryOutboxModel) update(ctx context.Context, id int64, fn func(email *memoryEmail)) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	email, ok := m.store.outbox[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	fn(email)
+
+	return nil
+}
+
+type memoryLoginAttemptModel struct {
+	store *memoryStore
+}
+
+func (m memoryLoginAttemptModel) Get(ctx context.Context, email string) (*LoginAttempts, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if attempts, ok := m.store.loginAttempts[strings.ToLower(email)]; ok {
+		c := *attempts
+		return &c, nil
+	}
+
+	return &LoginAttempts{Email: email}, nil
+}
+
+func (m memoryLoginAttemptModel) RecordFailure(ctx context.Context, email string, window time.Duration) (int, error) {
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	now := time.Now()
+	for key, a := range m.store.loginAttempts {
+		if a.LastFailureAt.Before(now.Add(-window)) && !a.Locked(now) {
+			delete(m.store.loginAttempts, key)
+		}
+	}
+
+	attempts, ok := m.store.loginAttempts[strings.ToLower(email)]
+	if !ok {
+		attempts = &LoginAttempts{Email: email}
+		m.store.loginAttempts[strings.ToLower(email)] = attempts
+	}
+
+	if attempts.LastFailureAt.Before(now.Add(-window)) {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now.Truncate(time.Second)
+
+	return attempts.Failures, nil
+}
+
+func (m memoryLoginAttemptModel) Lock(ctx context.Context, email string, until time.Time) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if attempts, ok := m.store.loginAttempts[strings.ToLower(email)]; ok {
+		attempts.LockedUntil = until
+	}
+
+	return nil
+}
+
+func (m memoryLoginAttemptModel) Reset(ctx context.Context, email string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	delete(m.store.loginAttempts, strings.ToLower(email))
+
+	return nil
+}
+
+type memoryTwoFactorModel struct {
+	store *memoryStore
+}
+
+func (m memoryTwoFactorModel) Get(ctx context.Context, userID int64) (*TwoFactor, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	twoFactor, ok := m.store.twoFactor[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	c := *twoFactor
+	return &c, nil
+}
+
+func (m memoryTwoFactorModel) SetPending(ctx context.Context, userID int64, secret string) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	if twoFactor, ok := m.store.twoFactor[userID]; ok && twoFactor.Enabled {
+		return ErrEditConflict
+	}
+
+	m.store.twoFactor[userID] = &TwoFactor{UserID: userID, Secret: secret}
+
+	return nil
+}
+
+func (m memoryTwoFactorModel) Enable(ctx context.Context, userID, step int64, recoveryCodeHashes [][]byte) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	twoFactor, ok := m.store.twoFactor[userID]
+	if !ok || twoFactor.Enabled {
+		return ErrRecordNotFound
+	}
+
+	twoFactor.Enabled = true
+	twoFactor.LastStep = step
+	m.store.recoveryCodes[userID] = slices.Clone(recoveryCodeHashes)
+
+	return nil
+}
+
+func (m memoryTwoFactorModel) UseStep(ctx context.Context, userID, step int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	twoFactor, ok := m.store.twoFactor[userID]
+	if !ok || twoFactor.LastStep >= step {
+		return ErrRecordNotFound
+	}
+
+	twoFactor.LastStep = step
+
+	return nil
+}
+
+func (m memoryTwoFactorModel) UseRecoveryCode(ctx context.Context, userID int64, hash []byte) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	codes := m.store.recoveryCodes[userID]
+	i := slices.IndexFunc(codes, func(h []byte) bool {
+		return bytes.Equal(h, hash)
+	})
+	if i == -1 {
+		return ErrRecordNotFound
+	}
+
+	m.store.recoveryCodes[userID] = slices.Delete(codes, i, i+1)
+
+	return nil
+}
+
+func (m memoryTwoFactorModel) Delete(ctx context.Context, userID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	delete(m.store.twoFactor, userID)
+	delete(m.store.recoveryCodes, userID)
+
+	return nil
+}
+
+type memoryAPIKeyModel struct {
+	store *memoryStore
+}
+
+func copyAPIKey(key *APIKey) *APIKey {
+	c := *key
+	c.Plaintext = ""
+	c.Permissions = slices.Clone(key.Permissions)
+	if key.LastUsedAt != nil {
+		lastUsedAt := *key.LastUsedAt
+		c.LastUsedAt = &lastUsedAt
+	}
+	return &c
+}
+
+func (m memoryAPIKeyModel) Insert(ctx context.Context, key *APIKey) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+	key.Plaintext = APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	key.Hash = TokenHash(key.Plaintext)
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	m.store.lastAPIKeyID++
+	key.ID = m.store.lastAPIKeyID
+	key.CreatedAt = time.Now().Truncate(time.Second)
+
+	m.store.apiKeys[key.ID] = copyAPIKey(key)
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) GetByHash(ctx context.Context, hash []byte) (*APIKey, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for _, key := range m.store.apiKeys {
+		if bytes.Equal(key.Hash, hash) {
+			return copyAPIKey(key), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryAPIKeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	keys := []*APIKey{}
+	for _, key := range m.store.apiKeys {
+		if key.UserID == userID {
+			keys = append(keys, copyAPIKey(key))
+		}
+	}
+	slices.SortFunc(keys, func(a, b *APIKey) int {
+		return compareIDs(b.ID, a.ID)
+	})
+
+	return keys, nil
+}
+
+func (m memoryAPIKeyModel) Touch(ctx context.Context, id int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	key, ok := m.store.apiKeys[id]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now().Truncate(time.Second)
+	if key.LastUsedAt == nil || key.LastUsedAt.Before(now.Add(-time.Minute)) {
+		key.LastUsedAt = &now
+	}
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) Delete(ctx context.Context, id, userID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	key, ok := m.store.apiKeys[id]
+	if !ok || key.UserID != userID {
+		return ErrRecordNotFound
+	}
+
+	delete(m.store.apiKeys, id)
+
+	return nil
+}
+
+func (m memoryAPIKeyModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	for id, key := range m.store.apiKeys {
+		if key.UserID == userID {
+			delete(m.store.apiKeys, id)
+		}
+	}
+
+	return nil
+}
+
+type memoryOIDCLoginModel struct {
+	store *memoryStore
+}
+
+func (m memoryOIDCLoginModel) Insert(ctx context.Context, login *OIDCLogin) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	now := time.Now()
+	for key, l := range m.store.oidcLogins {
+		if l.Expiry.Before(now) {
+			delete(m.store.oidcLogins, key)
+		}
+	}
+
+	c := *login
+	c.State = ""
+	m.store.oidcLogins[string(TokenHash(login.State))] = &c
+
+	return nil
+}
+
+func (m memoryOIDCLoginModel) Consume(ctx context.Context, state string) (*OIDCLogin, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	m.store.mu.Lock()
+	defer m.store.mu.Unlock()
+
+	key := string(TokenHash(state))
+	login, ok := m.store.oidcLogins[key]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+	delete(m.store.oidcLogins, key)
+
+	if time.Now().After(login.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	c := *login
+	c.State = state
+	return &c, nil
+}
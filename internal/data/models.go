@@ -1,7 +1,9 @@
 package data
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
@@ -9,22 +11,162 @@ import (
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	// Returned when a query is aborted because the caller's context was canceled,
+	// e.g. the client went away or the server is shutting down.
+	ErrQueryCanceled = errors.New("query canceled")
+	// Returned when a query didn't complete before its deadline.
+	ErrQueryTimeout = errors.New("query timeout")
+	// Returned when a refresh token which has already been exchanged is used again.
+	ErrTokenReused = errors.New("token reused")
 )
 
+// The repository interfaces below describe the data layer as it is used by the
+// handlers. The *Model types implement them on top of PostgreSQL, and NewMemoryModels()
+// provides an in-memory implementation with the same semantics.
+
+type MovieRepository interface {
+	GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+	Insert(ctx context.Context, movie *Movie) error
+	Get(ctx context.Context, id int64) (*Movie, error)
+	Update(ctx context.Context, movie *Movie) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type UserRepository interface {
+	GetAll(ctx context.Context, email, name string, activated *bool, filters Filters) ([]*User, Metadata, error)
+	Insert(ctx context.Context, user *User) error
+	InsertWithRole(ctx context.Context, user *User, roleName string) error
+	Get(ctx context.Context, id int64) (*User, error)
+	GetStatus(ctx context.Context, id int64) (*UserStatus, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Update(ctx context.Context, user *User) error
+	GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+}
+
+type TokenRepository interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	DeleteAllScopesForUser(ctx context.Context, userID int64) error
+	DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, keepHash []byte) error
+	DeleteByHash(ctx context.Context, hash []byte) error
+	NewSession(ctx context.Context, userID int64, ttl time.Duration, client Client) (*Token, error)
+	NewRefresh(ctx context.Context, userID int64, ttl time.Duration, client Client, previous *Token) (*Token, error)
+	UseRefresh(ctx context.Context, tokenPlaintext string) (*Token, error)
+	DeleteFamily(ctx context.Context, family string) error
+	DeleteAllForUserExceptFamily(ctx context.Context, scope string, userID int64, keepFamily string) error
+	GetSessionsForUser(ctx context.Context, userID int64) ([]*Session, error)
+	DeleteSession(ctx context.Context, id, userID int64) error
+	Touch(ctx context.Context, hash []byte) error
+}
+
+type PermissionRepository interface {
+	GetAll(ctx context.Context) (Permissions, error)
+	GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+	GetDirectForUser(ctx context.Context, userID int64) (Permissions, error)
+	AddForUser(ctx context.Context, userID int64, codes ...string) error
+	RemoveForUser(ctx context.Context, userID int64, codes ...string) error
+	ReplaceForUser(ctx context.Context, userID int64, codes ...string) error
+}
+
+type RoleRepository interface {
+	GetAll(ctx context.Context) ([]*Role, error)
+	GetByName(ctx context.Context, name string) (*Role, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]*Role, error)
+	Insert(ctx context.Context, role *Role) error
+	AddPermissions(ctx context.Context, roleID int64, codes ...string) error
+	AssignToUser(ctx context.Context, userID, roleID int64) error
+	UnassignFromUser(ctx context.Context, userID, roleID int64) error
+}
+
+type AuditRepository interface {
+	Insert(ctx context.Context, entry *AuditEntry) error
+}
+
+type OutboxRepository interface {
+	Enqueue(ctx context.Context, email *Email) error
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]*Email, error)
+	MarkSent(ctx context.Context, id int64) error
+	MarkFailed(ctx context.Context, id int64, lastError string, retryAt time.Time) error
+	MarkDead(ctx context.Context, id int64, lastError string) error
+}
+
+type LoginAttemptRepository interface {
+	Get(ctx context.Context, email string) (*LoginAttempts, error)
+	RecordFailure(ctx context.Context, email string, window time.Duration) (int, error)
+	Lock(ctx context.Context, email string, until time.Time) error
+	Reset(ctx context.Context, email string) error
+}
+
+type TwoFactorRepository interface {
+	Get(ctx context.Context, userID int64) (*TwoFactor, error)
+	SetPending(ctx context.Context, userID int64, secret string) error
+	Enable(ctx context.Context, userID, step int64, recoveryCodeHashes [][]byte) error
+	UseStep(ctx context.Context, userID, step int64) error
+	UseRecoveryCode(ctx context.Context, userID int64, hash []byte) error
+	Delete(ctx context.Context, userID int64) error
+}
+
+type APIKeyRepository interface {
+	Insert(ctx context.Context, key *APIKey) error
+	GetByHash(ctx context.Context, hash []byte) (*APIKey, error)
+	GetAllForUser(ctx context.Context, userID int64) ([]*APIKey, error)
+	Touch(ctx context.Context, id int64) error
+	Delete(ctx context.Context, id, userID int64) error
+	DeleteAllForUser(ctx context.Context, userID int64) error
+}
+
+type OIDCLoginRepository interface {
+	Insert(ctx context.Context, login *OIDCLogin) error
+	Consume(ctx context.Context, state string) (*OIDCLogin, error)
+}
+
 type Models struct {
-	Movies      MovieModel
-	Users       UserModel
-	Tokens      TokenModel
-	Permissions PermissionModel
+	Movies        MovieRepository
+	Users         UserRepository
+	Tokens        TokenRepository
+	Permissions   PermissionRepository
+	Roles         RoleRepository
+	Audit         AuditRepository
+	Outbox        OutboxRepository
+	LoginAttempts LoginAttemptRepository
+	TwoFactor     TwoFactorRepository
+	APIKeys       APIKeyRepository
+	OIDCLogins    OIDCLoginRepository
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
-// the initialized MovieModel.
+// the PostgreSQL backed models.
 func NewModels(db *pgxpool.Pool) Models {
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:        MovieModel{DB: db},
+		Users:         UserModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Roles:         RoleModel{DB: db},
+		Audit:         AuditModel{DB: db},
+		Outbox:        OutboxModel{DB: db},
+		LoginAttempts: LoginAttemptModel{DB: db},
+		TwoFactor:     TwoFactorModel{DB: db},
+		APIKeys:       APIKeyModel{DB: db},
+		OIDCLogins:    OIDCLoginModel{DB: db},
+	}
+}
+
+// The contextError() helper translates a query error caused by the context being done
+// into ErrQueryCanceled or ErrQueryTimeout, so that callers can tell cancellations apart
+// from genuine database failures. Any other error (including nil) is returned unchanged.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return ErrQueryCanceled
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return ErrQueryTimeout
+	default:
+		return err
 	}
 }
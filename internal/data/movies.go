@@ -43,8 +43,50 @@ type MovieModel struct {
 	DB *pgxpool.Pool
 }
 
+// Return the value of the given sort column for the movie, together with its id.
+func (movie *Movie) cursorKey(column string) *cursorKey {
+	var value any
+	switch column {
+	case "title":
+		value = movie.Title
+	case "year":
+		value = int64(movie.Year)
+	case "runtime":
+		value = int64(movie.Runtime)
+	default:
+		value = movie.ID
+	}
+
+	return &cursorKey{value: value, id: movie.ID}
+}
+
+// Check that a decoded cursor value has the type of the sort column it is compared with.
+func validMovieCursor(column string, c cursor) bool {
+	switch c.Value.(type) {
+	case string:
+		return column == "title"
+	case int64:
+		return column != "title"
+	default:
+		return false
+	}
+}
+
+// Return the keys of the first and last movies in a page (nil for an empty page).
+func movieCursorKeys(movies []*Movie, column string) (first, last *cursorKey) {
+	if len(movies) == 0 {
+		return nil, nil
+	}
+
+	return movies[0].cursorKey(column), movies[len(movies)-1].cursorKey(column)
+}
+
 // Create a new GetAll() method which returns a slice of movies.
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	if filters.Cursor != "" {
+		return m.getAllFromCursor(ctx, title, genres, filters)
+	}
+
 	query := fmt.Sprintf(`
         SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
         FROM movies
@@ -53,14 +95,14 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
         ORDER BY %s %s, id ASC
         LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	args := []any{title, genres, filters.limit(), filters.offset()}
 
 	rows, err := m.DB.Query(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, contextError(ctx, err)
 	}
 	defer rows.Close()
 
@@ -80,21 +122,62 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Version,
 		)
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, Metadata{}, contextError(ctx, err)
 		}
 		movies = append(movies, &movie)
 	}
 
 	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, contextError(ctx, err)
 	}
 
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	first, last := movieCursorKeys(movies, filters.sortColumn())
+	metadata.addCursors(filters, first, last)
 
 	return movies, metadata, nil
 }
 
-func (m MovieModel) Insert(movie *Movie) error {
+// Keyset pagination variant of GetAll(). Instead of skipping rows with OFFSET, it seeks
+// directly to the rows after (or before) the cursor position, which stays fast on deep
+// pages and isn't affected by rows being inserted or deleted between requests. One extra
+// row is fetched to find out whether there are more rows beyond this page.
+func (m MovieModel) getAllFromCursor(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	c, err := filters.decodeCursor()
+	if err != nil || !validMovieCursor(filters.sortColumn(), c) {
+		return nil, Metadata{}, ErrInvalidCursor
+	}
+
+	where, orderBy := filters.keysetClauses(c, "$3", "$4")
+
+	query := fmt.Sprintf(`
+        SELECT id, created_at, title, year, runtime, genres, version
+        FROM movies
+        WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
+        AND (genres @> $2 OR $2 = '{}')
+        AND %s
+        ORDER BY %s
+        LIMIT $5`, where, orderBy)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []any{title, genres, c.Value, c.ID, filters.limit() + 1}
+
+	rows, _ := m.DB.Query(ctx, query, args...)
+
+	movies, err := pgx.CollectRows(rows, pgx.RowToAddrOfStructByName[Movie])
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	movies, hasMore := trimKeysetPage(movies, filters.limit(), c.Before)
+	first, last := movieCursorKeys(movies, filters.sortColumn())
+
+	return movies, keysetMetadata(filters, c, first, last, hasMore), nil
+}
+
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	query := `
         INSERT INTO movies (title, year, runtime, genres) 
         VALUES ($1, $2, $3, $4)
@@ -102,13 +185,14 @@ func (m MovieModel) Insert(movie *Movie) error {
 
 	args := []any{movie.Title, movie.Year, movie.Runtime, movie.Genres}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	return m.DB.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	return contextError(ctx, err)
 }
 
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
@@ -118,7 +202,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
         FROM movies
         WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, _ := m.DB.Query(ctx, query, id)
@@ -128,14 +212,14 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrRecordNotFound
 		} else {
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
 	return movie, nil
 }
 
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
         UPDATE movies 
         SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
@@ -151,7 +235,7 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(&movie.Version)
@@ -160,14 +244,14 @@ func (m MovieModel) Update(movie *Movie) error {
 		case errors.Is(err, pgx.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
 
 	return nil
 }
 
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -176,12 +260,12 @@ func (m MovieModel) Delete(id int64) error {
         DELETE FROM movies
         WHERE id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	result, err := m.DB.Exec(ctx, query, id)
 	if err != nil {
-		return err
+		return contextError(ctx, err)
 	}
 	// Call the RowsAffected() method on the sql.Result object to get the number of rows affected by the query.
 	rowsAffected := result.RowsAffected()
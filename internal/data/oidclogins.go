@@ -0,0 +1,76 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// An OIDCLogin is a login with the OpenID Connect provider which has been started but
+// not completed yet. It remembers the secrets that must be presented when the provider
+// redirects back: the nonce for the ID token and the PKCE code verifier.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+// An OIDCLoginModel struct type which wraps a connection pool.
+type OIDCLoginModel struct {
+	DB *pgxpool.Pool
+}
+
+// Insert a pending login, keyed by the hash of its state. Logins which were abandoned
+// and have expired are cleaned up at the same time.
+func (m OIDCLoginModel) Insert(ctx context.Context, login *OIDCLogin) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, `DELETE FROM oidc_logins WHERE expiry < NOW()`)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	query := `
+        INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+        VALUES ($1, $2, $3, $4)`
+
+	args := []any{TokenHash(login.State), login.Nonce, login.CodeVerifier, login.Expiry}
+
+	_, err = m.DB.Exec(ctx, query, args...)
+	return contextError(ctx, err)
+}
+
+// Delete and return the pending login for a state, so that it can't be completed twice.
+// If there is no such login or it has expired, ErrRecordNotFound is returned.
+func (m OIDCLoginModel) Consume(ctx context.Context, state string) (*OIDCLogin, error) {
+	query := `
+        DELETE FROM oidc_logins
+        WHERE state_hash = $1
+        RETURNING nonce, code_verifier, expiry`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	login := OIDCLogin{State: state}
+
+	err := m.DB.QueryRow(ctx, query, TokenHash(state)).Scan(&login.Nonce, &login.CodeVerifier, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	if time.Now().After(login.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
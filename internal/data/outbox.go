@@ -0,0 +1,169 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Delivery statuses of an Email. Dead emails have failed too many times and are no
+// longer retried.
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+// An Email waiting in the outbox to be rendered from Template and sent to Recipient.
+type Email struct {
+	ID            int64
+	CreatedAt     time.Time
+	Recipient     string
+	Template      string
+	Data          map[string]any
+	Status        string
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// Decode the template data of an email. Numbers are kept as json.Number, so that IDs
+// are rendered the same way as before the round trip rather than as floats.
+func decodeEmailData(js []byte) (map[string]any, error) {
+	data := map[string]any{}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// An OutboxModel struct type which wraps a connection pool.
+type OutboxModel struct {
+	DB *pgxpool.Pool
+}
+
+// Add an email to the outbox, to be sent as soon as a worker picks it up.
+func (m OutboxModel) Enqueue(ctx context.Context, email *Email) error {
+	query := `
+        INSERT INTO email_outbox (recipient, template, data)
+        VALUES ($1, $2, $3)
+        RETURNING id, created_at, status, next_attempt_at`
+
+	if email.Data == nil {
+		email.Data = map[string]any{}
+	}
+
+	args := []any{email.Recipient, email.Template, email.Data}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&email.ID, &email.CreatedAt, &email.Status, &email.NextAttemptAt)
+	return contextError(ctx, err)
+}
+
+// Claim up to limit pending emails which are due, counting this as an attempt. Claimed
+// emails aren't due again until lease has passed, so if the process dies while sending
+// them they are retried afterwards, and concurrent workers never claim the same email.
+func (m OutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*Email, error) {
+	query := `
+        UPDATE email_outbox
+        SET attempts = attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+        WHERE id IN (
+            SELECT id FROM email_outbox
+            WHERE status = 'pending' AND next_attempt_at <= NOW()
+            ORDER BY next_attempt_at, id
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, created_at, recipient, template, data, status, attempts, next_attempt_at, last_error`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query, limit, lease.Seconds())
+
+	emails, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Email, error) {
+		var (
+			email Email
+			data  []byte
+		)
+		err := row.Scan(
+			&email.ID,
+			&email.CreatedAt,
+			&email.Recipient,
+			&email.Template,
+			&data,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+		)
+		if err != nil {
+			return nil, err
+		}
+		email.Data, err = decodeEmailData(data)
+		return &email, err
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return emails, nil
+}
+
+// Record that an email has been sent. The template data is cleared, since it can hold
+// tokens which mustn't outlive the email.
+func (m OutboxModel) MarkSent(ctx context.Context, id int64) error {
+	query := `
+        UPDATE email_outbox
+        SET status = 'sent', sent_at = NOW(), last_error = '', data = '{}'
+        WHERE id = $1`
+
+	return m.exec(ctx, query, id)
+}
+
+// Record a failed attempt to send an email, which is retried at retryAt.
+func (m OutboxModel) MarkFailed(ctx context.Context, id int64, lastError string, retryAt time.Time) error {
+	query := `
+        UPDATE email_outbox
+        SET last_error = $2, next_attempt_at = $3
+        WHERE id = $1`
+
+	return m.exec(ctx, query, id, lastError, retryAt)
+}
+
+// Record a failed attempt to send an email, which isn't retried anymore. Like for sent
+// emails, the template data is cleared.
+func (m OutboxModel) MarkDead(ctx context.Context, id int64, lastError string) error {
+	query := `
+        UPDATE email_outbox
+        SET status = 'dead', last_error = $2, data = '{}'
+        WHERE id = $1`
+
+	return m.exec(ctx, query, id, lastError)
+}
+
+func (m OutboxModel) exec(ctx context.Context, query string, args ...any) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, args...)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
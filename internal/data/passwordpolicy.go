@@ -0,0 +1,392 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/igredk/greenlight/internal/validator"
+)
+
+// The highest password strength score.
+const maxPasswordStrength = 4
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+var commonPasswords = sync.OnceValue(func() map[string]bool {
+	passwords := make(map[string]bool)
+	for _, line := range strings.Split(commonPasswordsFile, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[line] = true
+		}
+	}
+	return passwords
+})
+
+// BreachedPasswords is a list of SHA-1 hashes of passwords which are known to have been
+// leaked in data breaches, such as the Pwned Passwords list of Have I Been Pwned. The list
+// stays on disk, and only the part of it which can hold a password is read to look it up.
+type BreachedPasswords struct {
+	// Set if the list is a directory with one file per hash prefix.
+	dir string
+	// Set if the list is a single file sorted by hash.
+	file *os.File
+	size int64
+}
+
+// The number of hex digits of the hash prefixes which the Pwned Passwords range API and
+// the files of its downloader are keyed on.
+const breachedPrefixLen = 5
+
+// The longest line expected in a list, which is a hash followed by a count and a CRLF.
+const breachedMaxLineLen = 64
+
+// OpenBreachedPasswords opens a list of breached passwords in one of the formats written
+// by the Pwned Passwords downloader. If path is a directory, it must hold a file named
+// after each 5 hex digit hash prefix plus ".txt", with the remaining 35 hex digits of a
+// hash per line. Otherwise it must be a file with a full 40 hex digit hash per line,
+// sorted by hash. Either way, a hash may be followed by a colon and the number of times
+// it has been seen, and upper- and lowercase hex digits both work.
+func OpenBreachedPasswords(path string) (*BreachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list BreachedPasswords
+	if info.IsDir() {
+		list.dir = path
+	} else {
+		list.file, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		list.size = info.Size()
+	}
+
+	// Look up a hash to find out early if the list can't be read or is in the wrong
+	// format.
+	_, err = list.containsHash(strings.Repeat("0", hex.EncodedLen(sha1.Size)))
+	if err != nil {
+		if list.file != nil {
+			list.file.Close()
+		}
+		return nil, err
+	}
+
+	return &list, nil
+}
+
+// Contains reports if a password is in the list.
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	hash := sha1.Sum([]byte(password))
+	return b.containsHash(strings.ToUpper(hex.EncodeToString(hash[:])))
+}
+
+func (b *BreachedPasswords) containsHash(hash string) (bool, error) {
+	if b.dir != "" {
+		return b.searchPrefixFile(hash)
+	}
+	return b.searchSortedFile(hash)
+}
+
+// Look a hash up in the file for its prefix, which holds about two thousand hashes for
+// the full Pwned Passwords list.
+func (b *BreachedPasswords) searchPrefixFile(hash string) (bool, error) {
+	prefix, suffix := hash[:breachedPrefixLen], hash[breachedPrefixLen:]
+
+	path := filepath.Join(b.dir, prefix+".txt")
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		text, err := breachedHash(scanner.Text(), len(suffix))
+		if err != nil {
+			return false, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if text == suffix {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// Binary search the sorted file for a hash, which takes a read for each halving of the
+// part of the file the hash can still be in.
+func (b *BreachedPasswords) searchSortedFile(hash string) (bool, error) {
+	// If the hash is in the file, its line starts between lo (inclusive) and hi
+	// (exclusive).
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		start, line, err := b.lineAt(mid)
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+
+		text, err := breachedHash(line, len(hash))
+		if err != nil {
+			return false, fmt.Errorf("%s: offset %d: %w", b.file.Name(), start, err)
+		}
+
+		switch strings.Compare(text, hash) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = start + int64(len(line)) + 1
+		default:
+			// No line starts between mid and this one.
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+// Return the first line of the sorted file which starts at or after offset, along with
+// the offset it starts at. If there is no such line, the offset returned is the size of
+// the file.
+func (b *BreachedPasswords) lineAt(offset int64) (int64, string, error) {
+	// Read from the byte before offset, so that a line starting right at offset can
+	// be told from one which started earlier.
+	readFrom := max(offset-1, 0)
+	buf := make([]byte, 3*breachedMaxLineLen)
+	n, err := b.file.ReadAt(buf, readFrom)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, "", err
+	}
+	buf = buf[:n]
+
+	if offset > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			if readFrom+int64(n) >= b.size {
+				return b.size, "", nil
+			}
+			return 0, "", fmt.Errorf("%s: offset %d: line too long", b.file.Name(), readFrom)
+		}
+		buf = buf[i+1:]
+		readFrom += int64(i + 1)
+	}
+	if len(buf) == 0 {
+		return b.size, "", nil
+	}
+
+	line, _, found := bytes.Cut(buf, []byte("\n"))
+	if !found && readFrom+int64(len(buf)) < b.size {
+		return 0, "", fmt.Errorf("%s: offset %d: line too long", b.file.Name(), readFrom)
+	}
+
+	return readFrom, string(line), nil
+}
+
+// Return the uppercased hash of a line of a breached passwords list, checking that it is
+// made of length hex digits.
+func breachedHash(line string, length int) (string, error) {
+	text, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	if len(text) != length || strings.TrimLeft(text, "0123456789abcdefABCDEF") != "" {
+		return "", errors.New("invalid SHA-1 hash")
+	}
+	return strings.ToUpper(text), nil
+}
+
+// PasswordPolicy holds the rules new passwords have to follow, on top of the length limits.
+type PasswordPolicy struct {
+	// Minimum strength score, from 0 to 4, see PasswordStrength.
+	MinStrength int
+	// Reject passwords from the embedded list of the 10,000 most common passwords, and
+	// passwords which only add digits or symbols to one of them.
+	RejectCommon bool
+	// Reject passwords from this list, if it is set.
+	Breached *BreachedPasswords
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinStrength:  2,
+	RejectCommon: true,
+}
+
+var (
+	passwordPolicyMu sync.RWMutex
+	passwordPolicy   = DefaultPasswordPolicy
+)
+
+// SetPasswordPolicy changes the policy new passwords are checked against. It is meant to
+// be called once on startup.
+func SetPasswordPolicy(policy PasswordPolicy) error {
+	if policy.MinStrength < 0 || policy.MinStrength > maxPasswordStrength {
+		return fmt.Errorf("minimum password strength must be between 0 and %d", maxPasswordStrength)
+	}
+
+	passwordPolicyMu.Lock()
+	defer passwordPolicyMu.Unlock()
+
+	passwordPolicy = policy
+
+	return nil
+}
+
+func currentPasswordPolicy() PasswordPolicy {
+	passwordPolicyMu.RLock()
+	defer passwordPolicyMu.RUnlock()
+
+	return passwordPolicy
+}
+
+// ValidatePasswordPolicy checks a new password for a user against the password policy.
+// Unlike ValidatePasswordPlaintext(), which is enough for checking the password of a login,
+// this must be used whenever a user chooses a password. The error message includes the
+// strength score of the password, so that clients can show it.
+func ValidatePasswordPolicy(v *validator.Validator, password string, user *User) {
+	policy := currentPasswordPolicy()
+	strength := PasswordStrength(password)
+
+	var breached bool
+	var breachedErr error
+	if policy.Breached != nil {
+		breached, breachedErr = policy.Breached.Contains(password)
+	}
+
+	var problem string
+	switch {
+	case policy.RejectCommon && isCommonPassword(password):
+		problem = "is too common"
+		strength = 0
+	case breached:
+		problem = "has appeared in a data breach"
+		strength = 0
+	case breachedErr != nil:
+		// Rather than let the password through unchecked, have it tried again.
+		problem = "could not be checked against breached passwords, please try again later"
+		strength = 0
+	case containsPersonalInfo(password, user):
+		problem = "must not contain your name or email address"
+		strength = 0
+	case strength < policy.MinStrength:
+		problem = fmt.Sprintf("is too weak, a strength of at least %d is required", policy.MinStrength)
+	default:
+		return
+	}
+
+	v.AddError("password", fmt.Sprintf("%s (strength %d of %d)", problem, strength, maxPasswordStrength))
+}
+
+// Report if a password is a common one, ignoring case as well as digits and symbols added
+// before or after it, which is how many people satisfy composition rules.
+func isCommonPassword(password string) bool {
+	password = strings.ToLower(password)
+	core := strings.TrimFunc(password, func(r rune) bool {
+		return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+	})
+
+	return commonPasswords()[password] || (len(core) >= 4 && commonPasswords()[core])
+}
+
+// Report if a password contains the user's email address, the part of it before the @,
+// or the user's name or any part of it.
+func containsPersonalInfo(password string, user *User) bool {
+	if user == nil {
+		return false
+	}
+
+	email := strings.ToLower(user.Email)
+	localPart, _, _ := strings.Cut(email, "@")
+	name := strings.ToLower(user.Name)
+
+	inputs := append([]string{email, localPart, name}, strings.Fields(name)...)
+
+	password = strings.ToLower(password)
+	for _, input := range inputs {
+		if len(input) >= 3 && strings.Contains(password, input) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// PasswordStrength estimates how hard a password is to guess, from 0 (trivial) to 4
+// (strong). The estimate is based on the kinds of characters used and the length, where
+// characters repeating or continuing a sequence (like "aaa" or "1234") count for little.
+// It doesn't know about common passwords or words, which ValidatePasswordPolicy() checks
+// separately.
+func PasswordStrength(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	charset := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.used {
+			charset += class.size
+		}
+	}
+	if charset == 0 {
+		return 0
+	}
+
+	length := 0.0
+	prev := rune(-1)
+	for _, r := range password {
+		if r == prev || r == prev+1 || r == prev-1 {
+			length += 0.25
+		} else {
+			length++
+		}
+		prev = r
+	}
+
+	bits := length * math.Log2(float64(charset))
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 60:
+		return 2
+	case bits < 80:
+		return 3
+	default:
+		return 4
+	}
+}
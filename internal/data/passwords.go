@@ -0,0 +1,224 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Algorithms for hashing passwords.
+const (
+	PasswordArgon2id = "argon2id"
+	PasswordBcrypt   = "bcrypt"
+)
+
+// bcrypt only looks at the first 72 bytes of a password. Argon2id has no such limit, but
+// hashing megabytes of password on every login would be an easy way to waste our CPU.
+const (
+	maxBcryptPasswordLength = 72
+	maxPasswordLength       = 1024
+)
+
+var errInvalidHash = errors.New("invalid password hash")
+
+// PasswordParams selects the algorithm, and its parameters, that new password hashes are
+// created with. Existing hashes are recognized by their format and keep working, but are
+// replaced on the next successful login if they don't match the current parameters.
+type PasswordParams struct {
+	Algorithm  string
+	BcryptCost int
+	// Argon2id parameters: memory in KiB, number of passes and degree of parallelism.
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+}
+
+// The defaults follow the OWASP recommendations for argon2id.
+var DefaultPasswordParams = PasswordParams{
+	Algorithm:         PasswordArgon2id,
+	BcryptCost:        12,
+	Argon2Memory:      19 * 1024,
+	Argon2Iterations:  2,
+	Argon2Parallelism: 1,
+}
+
+var (
+	passwordParamsMu sync.RWMutex
+	passwordParams   = DefaultPasswordParams
+)
+
+// SetPasswordParams changes the parameters new password hashes are created with. It is
+// meant to be called once on startup, before any passwords are hashed.
+func SetPasswordParams(params PasswordParams) error {
+	switch params.Algorithm {
+	case PasswordArgon2id:
+		if params.Argon2Iterations < 1 || params.Argon2Parallelism < 1 {
+			return errors.New("argon2id iterations and parallelism must be at least 1")
+		}
+		if params.Argon2Memory < 8*uint32(params.Argon2Parallelism) {
+			return errors.New("argon2id memory must be at least 8 KiB per degree of parallelism")
+		}
+	case PasswordBcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", params.Algorithm)
+	}
+
+	passwordParamsMu.Lock()
+	defer passwordParamsMu.Unlock()
+
+	passwordParams = params
+
+	return nil
+}
+
+func currentPasswordParams() PasswordParams {
+	passwordParamsMu.RLock()
+	defer passwordParamsMu.RUnlock()
+
+	return passwordParams
+}
+
+// MaxPasswordLength returns the maximum length of new passwords, which depends on the
+// current algorithm.
+func MaxPasswordLength() int {
+	if currentPasswordParams().Algorithm == PasswordBcrypt {
+		return maxBcryptPasswordLength
+	}
+	return maxPasswordLength
+}
+
+// Argon2id hashes are stored in the PHC string format, as most other implementations do:
+// $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>, with the salt and key in unpadded base64.
+type argon2Hash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (h *argon2Hash) encode() []byte {
+	return fmt.Appendf(nil, "$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.memory,
+		h.iterations,
+		h.parallelism,
+		base64.RawStdEncoding.EncodeToString(h.salt),
+		base64.RawStdEncoding.EncodeToString(h.key),
+	)
+}
+
+func decodeArgon2Hash(hash []byte) (*argon2Hash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, errInvalidHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, errInvalidHash
+	}
+
+	var h argon2Hash
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism)
+	if err != nil {
+		return nil, errInvalidHash
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, errInvalidHash
+	}
+	h.key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(h.key) == 0 {
+		return nil, errInvalidHash
+	}
+
+	return &h, nil
+}
+
+func isArgon2Hash(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+// Hash a plaintext password with the current algorithm and parameters.
+func hashPassword(plaintext string) ([]byte, error) {
+	params := currentPasswordParams()
+
+	if params.Algorithm == PasswordBcrypt {
+		return bcrypt.GenerateFromPassword([]byte(plaintext), params.BcryptCost)
+	}
+
+	h := argon2Hash{
+		memory:      params.Argon2Memory,
+		iterations:  params.Argon2Iterations,
+		parallelism: params.Argon2Parallelism,
+		salt:        make([]byte, 16),
+	}
+	_, err := rand.Read(h.salt)
+	if err != nil {
+		return nil, err
+	}
+	h.key = argon2.IDKey([]byte(plaintext), h.salt, h.iterations, h.memory, h.parallelism, 32)
+
+	return h.encode(), nil
+}
+
+// Check a plaintext password against a hash in any of the supported formats.
+func comparePassword(hash []byte, plaintext string) (bool, error) {
+	if isArgon2Hash(hash) {
+		h, err := decodeArgon2Hash(hash)
+		if err != nil {
+			return false, err
+		}
+
+		key := argon2.IDKey([]byte(plaintext), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.key)))
+		return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+	}
+
+	// bcrypt would silently ignore everything after the first 72 bytes.
+	if len(plaintext) > maxBcryptPasswordLength {
+		return false, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// Report if a hash was made with another algorithm or other parameters than the current ones.
+func passwordNeedsRehash(hash []byte) bool {
+	params := currentPasswordParams()
+
+	if params.Algorithm == PasswordBcrypt {
+		cost, err := bcrypt.Cost(hash)
+		return err != nil || cost != params.BcryptCost
+	}
+
+	h, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return h.memory != params.Argon2Memory || h.iterations != params.Argon2Iterations || h.parallelism != params.Argon2Parallelism
+}
@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// PostgreSQL channel on which the triggers of the users_permissions, users_roles and
+// roles_permissions tables announce changes. The payload is the ID of the affected user,
+// or empty if the permissions of any number of users may have changed.
+const permissionsChannel = "permissions_changed"
+
+// A PermissionCache holds the effective permissions of recently seen users.
+type PermissionCache struct {
+	*userCache[Permissions]
+}
+
+// NewPermissionCache returns a cache holding the permissions of at most size users
+// for at most ttl.
+func NewPermissionCache(size int, ttl time.Duration) *PermissionCache {
+	return &PermissionCache{newUserCache[Permissions](size, ttl, permissionsChannel)}
+}
+
+// A cachedPermissionModel serves GetAllForUser from a PermissionCache, and invalidates
+// the cache on the changes it makes itself.
+type cachedPermissionModel struct {
+	PermissionRepository
+	cache *PermissionCache
+}
+
+func (m cachedPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	permissions, generation, ok := m.cache.get(userID)
+	if ok {
+		return slices.Clone(permissions), nil
+	}
+
+	permissions, err := m.PermissionRepository.GetAllForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.cache.put(userID, slices.Clone(permissions), generation)
+
+	return permissions, nil
+}
+
+func (m cachedPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer m.cache.Invalidate(userID)
+	return m.PermissionRepository.AddForUser(ctx, userID, codes...)
+}
+
+func (m cachedPermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer m.cache.Invalidate(userID)
+	return m.PermissionRepository.RemoveForUser(ctx, userID, codes...)
+}
+
+func (m cachedPermissionModel) ReplaceForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer m.cache.Invalidate(userID)
+	return m.PermissionRepository.ReplaceForUser(ctx, userID, codes...)
+}
+
+// A cachedRoleModel invalidates a PermissionCache on role changes which affect the
+// effective permissions of users.
+type cachedRoleModel struct {
+	RoleRepository
+	cache *PermissionCache
+}
+
+func (m cachedRoleModel) AddPermissions(ctx context.Context, roleID int64, codes ...string) error {
+	// Any number of users may have the role, so drop everything.
+	defer m.cache.Purge()
+	return m.RoleRepository.AddPermissions(ctx, roleID, codes...)
+}
+
+func (m cachedRoleModel) AssignToUser(ctx context.Context, userID, roleID int64) error {
+	defer m.cache.Invalidate(userID)
+	return m.RoleRepository.AssignToUser(ctx, userID, roleID)
+}
+
+func (m cachedRoleModel) UnassignFromUser(ctx context.Context, userID, roleID int64) error {
+	defer m.cache.Invalidate(userID)
+	return m.RoleRepository.UnassignFromUser(ctx, userID, roleID)
+}
+
+// CachePermissions makes the Permissions model serve lookups from cache, and the
+// Permissions and Roles models invalidate it on every change they make.
+func (m *Models) CachePermissions(cache *PermissionCache) {
+	m.Permissions = cachedPermissionModel{PermissionRepository: m.Permissions, cache: cache}
+	m.Roles = cachedRoleModel{RoleRepository: m.Roles, cache: cache}
+}
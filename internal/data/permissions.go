@@ -26,40 +26,132 @@ type PermissionModel struct {
 	DB *pgxpool.Pool
 }
 
-// Returns all permission codes for a specific user in a Permissions slice.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// Returns all permission codes which exist, ordered by code.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+        SELECT code
+        FROM permissions
+        ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query)
+
+	permissions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return Permissions(permissions), nil
+}
+
+// Returns all effective permission codes for a specific user in a Permissions slice. That is
+// the union of the permissions granted to the user directly and those of the user's roles.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
         SELECT permissions.code
         FROM permissions
         INNER JOIN users_permissions ON permissions.id = users_permissions.permission_id
-        INNER JOIN users ON users_permissions.user_id = users.id
-        WHERE users.id = $1`
+        WHERE users_permissions.user_id = $1
+        UNION
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN roles_permissions ON permissions.id = roles_permissions.permission_id
+        INNER JOIN users_roles ON roles_permissions.role_id = users_roles.role_id
+        WHERE users_roles.user_id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	rows, err := m.DB.Query(ctx, query, userID)
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
 
 	permissions, err := pgx.CollectRows(rows, pgx.RowTo[string])
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
+	}
+
+	return Permissions(permissions), nil
+}
+
+// Returns the permission codes granted to a specific user directly, without those of
+// the user's roles.
+func (m PermissionModel) GetDirectForUser(ctx context.Context, userID int64) (Permissions, error) {
+	query := `
+        SELECT permissions.code
+        FROM permissions
+        INNER JOIN users_permissions ON permissions.id = users_permissions.permission_id
+        WHERE users_permissions.user_id = $1
+        ORDER BY permissions.code`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query, userID)
+
+	permissions, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, contextError(ctx, err)
 	}
 
 	return Permissions(permissions), nil
 }
 
 // Add the provided permission codes for a specific user.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
         INSERT INTO users_permissions
         SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.Exec(ctx, query, userID, codes)
-	return err
+	return contextError(ctx, err)
+}
+
+// Remove the provided permission codes from a specific user. Codes the user doesn't
+// have directly are ignored.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+	query := `
+        DELETE FROM users_permissions
+        USING permissions
+        WHERE users_permissions.permission_id = permissions.id
+        AND users_permissions.user_id = $1 AND permissions.code = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, codes)
+	return contextError(ctx, err)
+}
+
+// Replace all direct permissions of a specific user with the provided codes, in a
+// single transaction.
+func (m PermissionModel) ReplaceForUser(ctx context.Context, userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM users_permissions WHERE user_id = $1`, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO users_permissions
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`, userID, codes)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit(ctx))
 }
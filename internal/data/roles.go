@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/igredk/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Role assigned to new users on registration.
+const DefaultRole = "viewer"
+
+var (
+	ErrDuplicateRole = errors.New("duplicate role")
+
+	RoleNameRX = regexp.MustCompile("^[a-z0-9_-]+$")
+)
+
+// A Role is a named set of permissions which can be assigned to users.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(role.Name, RoleNameRX), "name", "must only contain lowercase letters, digits, hyphens and underscores")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// A RoleModel struct type which wraps a connection pool.
+type RoleModel struct {
+	DB *pgxpool.Pool
+}
+
+// Select each role together with its sorted permission codes. Roles without any
+// permissions get an empty array rather than {NULL}.
+const selectRolesQuery = `
+        SELECT roles.id, roles.name,
+            COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+        FROM roles
+        LEFT JOIN roles_permissions ON roles.id = roles_permissions.role_id
+        LEFT JOIN permissions ON roles_permissions.permission_id = permissions.id`
+
+func collectRoles(rows pgx.Rows) ([]*Role, error) {
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Role, error) {
+		var role Role
+		err := row.Scan(&role.ID, &role.Name, &role.Permissions)
+		return &role, err
+	})
+}
+
+// Returns all roles ordered by name.
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	query := selectRolesQuery + `
+        GROUP BY roles.id
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query)
+
+	roles, err := collectRoles(rows)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return roles, nil
+}
+
+func (m RoleModel) GetByName(ctx context.Context, name string) (*Role, error) {
+	query := selectRolesQuery + `
+        WHERE roles.name = $1
+        GROUP BY roles.id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query, name)
+
+	roles, err := collectRoles(rows)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	if len(roles) == 0 {
+		return nil, ErrRecordNotFound
+	}
+
+	return roles[0], nil
+}
+
+// Returns the roles assigned to a specific user, ordered by name.
+func (m RoleModel) GetAllForUser(ctx context.Context, userID int64) ([]*Role, error) {
+	query := selectRolesQuery + `
+        INNER JOIN users_roles ON roles.id = users_roles.role_id
+        WHERE users_roles.user_id = $1
+        GROUP BY roles.id
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query, userID)
+
+	roles, err := collectRoles(rows)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return roles, nil
+}
+
+// Insert a new role along with its permissions. Codes which don't exist in the
+// permissions table are skipped, so callers should validate them beforehand.
+func (m RoleModel) Insert(ctx context.Context, role *Role) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `INSERT INTO roles (name) VALUES ($1) RETURNING id`, role.Name).Scan(&role.ID)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == UniqueConstraintViolation {
+			return ErrDuplicateRole
+		}
+		return contextError(ctx, err)
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO roles_permissions
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`, role.ID, role.Permissions)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit(ctx))
+}
+
+// Attach the provided permission codes to a role. Codes the role already has are ignored.
+func (m RoleModel) AddPermissions(ctx context.Context, roleID int64, codes ...string) error {
+	query := `
+        INSERT INTO roles_permissions
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, roleID, codes)
+	return contextError(ctx, err)
+}
+
+// Assign a role to a user. Assigning a role the user already has is a no-op. If the
+// user doesn't exist, ErrRecordNotFound is returned.
+func (m RoleModel) AssignToUser(ctx context.Context, userID, roleID int64) error {
+	query := `
+        INSERT INTO users_roles (user_id, role_id)
+        VALUES ($1, $2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID, roleID)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == ForeignKeyViolation {
+			return ErrRecordNotFound
+		}
+		return contextError(ctx, err)
+	}
+
+	return nil
+}
+
+// Remove a role from a user. If the user doesn't have the role, ErrRecordNotFound is returned.
+func (m RoleModel) UnassignFromUser(ctx context.Context, userID, roleID int64) error {
+	query := `
+        DELETE FROM users_roles
+        WHERE user_id = $1 AND role_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, roleID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
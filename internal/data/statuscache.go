@@ -0,0 +1,56 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// PostgreSQL channel on which a trigger of the users table announces that a user was
+// activated, deactivated, suspended or had their suspension lifted. The payload is the
+// ID of the affected user.
+const userStatusChannel = "user_status_changed"
+
+// A UserStatusCache holds the status of recently seen users.
+type UserStatusCache struct {
+	*userCache[UserStatus]
+}
+
+// NewUserStatusCache returns a cache holding the status of at most size users for at
+// most ttl.
+func NewUserStatusCache(size int, ttl time.Duration) *UserStatusCache {
+	return &UserStatusCache{newUserCache[UserStatus](size, ttl, userStatusChannel)}
+}
+
+// A cachedUserModel serves GetStatus from a UserStatusCache, and invalidates the cache
+// on the updates it makes itself.
+type cachedUserModel struct {
+	UserRepository
+	cache *UserStatusCache
+}
+
+func (m cachedUserModel) GetStatus(ctx context.Context, userID int64) (*UserStatus, error) {
+	status, generation, ok := m.cache.get(userID)
+	if ok {
+		return &status, nil
+	}
+
+	fetched, err := m.UserRepository.GetStatus(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	m.cache.put(userID, *fetched, generation)
+
+	return fetched, nil
+}
+
+func (m cachedUserModel) Update(ctx context.Context, user *User) error {
+	defer m.cache.Invalidate(user.ID)
+	return m.UserRepository.Update(ctx, user)
+}
+
+// CacheUserStatus makes the Users model serve status lookups from cache, and invalidate
+// it on every update it makes.
+func (m *Models) CacheUserStatus(cache *UserStatusCache) {
+	m.Users = cachedUserModel{UserRepository: m.Users, cache: cache}
+}
@@ -5,9 +5,11 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/igredk/greenlight/internal/validator"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -15,6 +17,12 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailChange    = "email-change"
+	ScopeUnlock         = "unlock"
+	ScopeTwoFactor      = "two-factor"
+	ScopeRefresh        = "refresh"
+	ScopeLogin          = "login"
 )
 
 // A Token struct to hold the data for an individual token.
@@ -24,13 +32,45 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// Refresh tokens only: the family of tokens issued in turn since a login, and if
+	// the token has already been exchanged for a new one.
+	Family string `json:"-"`
+	Used   bool   `json:"-"`
+	// Session metadata, which is recorded for authentication and refresh tokens.
+	ID         int64      `json:"-"`
+	CreatedAt  time.Time  `json:"-"`
+	LastUsedAt *time.Time `json:"-"`
+	Client     Client     `json:"-"`
+}
+
+// Client describes the client a session was started or last refreshed from.
+type Client struct {
+	IP        string
+	UserAgent string
+}
+
+// A Session is an authentication token, or the current refresh token of a family, as
+// it is shown to the user it belongs to.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	// Set by the handler listing the sessions, for the one making the request.
+	Current bool   `json:"current"`
+	Hash    []byte `json:"-"`
+	Family  string `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+	now := time.Now()
 	token := &Token{
-		UserID: userID,
-		Expiry: time.Now().Add(ttl),
-		Scope:  scope,
+		UserID:    userID,
+		Expiry:    now.Add(ttl),
+		Scope:     scope,
+		CreatedAt: now,
 	}
 	// Initialize a zero-valued byte slice with a length of 16 bytes.
 	randomBytes := make([]byte, 16)
@@ -47,10 +87,40 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	// we use the WithPadding(base32.NoPadding) method to omit them.
 	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 	// Generate a SHA-256 hash of the plaintext token string.
-	// sha256.Sum256() returns an array of length 32, so to make it easier to
-	// work with we convert it to a slice using the [:] operator before storing it.
-	hash := sha256.Sum256([]byte(token.Plaintext))
-	token.Hash = hash[:]
+	token.Hash = TokenHash(token.Plaintext)
+
+	return token, nil
+}
+
+// Returns the SHA-256 hash of a plaintext token, as it is stored in the tokens table.
+func TokenHash(tokenPlaintext string) []byte {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return hash[:]
+}
+
+// Generate a refresh token to replace the previous one of its family, or in a new family
+// if previous is nil. A replacement keeps the creation time of the session.
+func generateRefreshToken(userID int64, ttl time.Duration, client Client, previous *Token) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	token.Client = client
+
+	if previous != nil {
+		refreshedAt := token.CreatedAt
+		token.Family = previous.Family
+		token.LastUsedAt = &refreshedAt
+		token.CreatedAt = previous.CreatedAt
+		return token, nil
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
 	return token, nil
 }
@@ -67,39 +137,271 @@ type TokenModel struct {
 }
 
 // Creates a new Token struct and then inserts the data in the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
-        INSERT INTO tokens (hash, user_id, expiry, scope) 
-        VALUES ($1, $2, $3, $4)`
+        INSERT INTO tokens (hash, user_id, expiry, scope, family, created_at, last_used_at, ip, user_agent) 
+        VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9)
+        RETURNING id`
 
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []any{
+		token.Hash,
+		token.UserID,
+		token.Expiry,
+		token.Scope,
+		token.Family,
+		token.CreatedAt,
+		token.LastUsedAt,
+		token.Client.IP,
+		token.Client.UserAgent,
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.Exec(ctx, query, args...)
-	return err
+	err := m.DB.QueryRow(ctx, query, args...).Scan(&token.ID)
+	return contextError(ctx, err)
+}
+
+// Creates a new authentication token for a client and inserts it in the tokens table.
+func (m TokenModel) NewSession(ctx context.Context, userID int64, ttl time.Duration, client Client) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+	token.Client = client
+
+	err = m.Insert(ctx, token)
+	return token, err
 }
 
 // Deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
         DELETE FROM tokens 
         WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.Exec(ctx, query, scope, userID)
-	return err
+	return contextError(ctx, err)
+}
+
+// Deletes all tokens of a user, whatever their scope, e.g. when the user is suspended.
+func (m TokenModel) DeleteAllScopesForUser(ctx context.Context, userID int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, userID)
+	return contextError(ctx, err)
+}
+
+// Deletes all tokens for a specific user and scope, except for the token with the given
+// SHA-256 hash. This is used to sign a user out everywhere but in the current session.
+func (m TokenModel) DeleteAllForUserExcept(ctx context.Context, scope string, userID int64, keepHash []byte) error {
+	query := `
+        DELETE FROM tokens
+        WHERE scope = $1 AND user_id = $2 AND hash <> $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, scope, userID, keepHash)
+	return contextError(ctx, err)
+}
+
+// Deletes a single token by its SHA-256 hash. If no matching token exists, ErrRecordNotFound is returned.
+func (m TokenModel) DeleteByHash(ctx context.Context, hash []byte) error {
+	query := `
+        DELETE FROM tokens
+        WHERE hash = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, hash)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Creates a new refresh token to replace the previous one of its family, or in a new
+// family if previous is nil, and inserts it in the tokens table.
+func (m TokenModel) NewRefresh(ctx context.Context, userID int64, ttl time.Duration, client Client, previous *Token) (*Token, error) {
+	token, err := generateRefreshToken(userID, ttl, client, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+// Marks an unexpired refresh token as used, so that it can only be exchanged once. If the
+// token has been used before, the token is returned along with ErrTokenReused, so that
+// the caller can revoke its family. If there's no such token, ErrRecordNotFound is returned.
+func (m TokenModel) UseRefresh(ctx context.Context, tokenPlaintext string) (*Token, error) {
+	// The update only succeeds for one of several concurrent requests with the same token,
+	// and the others then find it used.
+	query := `
+        UPDATE tokens
+        SET used_at = NOW()
+        WHERE hash = $1 AND scope = $2 AND expiry > NOW() AND used_at IS NULL
+        RETURNING id, user_id, expiry, family, created_at, false`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	token := Token{
+		Hash:  TokenHash(tokenPlaintext),
+		Scope: ScopeRefresh,
+	}
+
+	err := m.DB.QueryRow(ctx, query, token.Hash, token.Scope).Scan(&token.ID, &token.UserID, &token.Expiry, &token.Family, &token.CreatedAt, &token.Used)
+	if err == nil {
+		return &token, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, contextError(ctx, err)
+	}
+
+	query = `
+        SELECT id, user_id, expiry, family, created_at, true
+        FROM tokens
+        WHERE hash = $1 AND scope = $2 AND expiry > NOW()`
+
+	err = m.DB.QueryRow(ctx, query, token.Hash, token.Scope).Scan(&token.ID, &token.UserID, &token.Expiry, &token.Family, &token.CreatedAt, &token.Used)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &token, ErrTokenReused
+}
+
+// Deletes all refresh tokens of a family, which signs out the session they belong to.
+func (m TokenModel) DeleteFamily(ctx context.Context, family string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE family = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, family)
+	return contextError(ctx, err)
+}
+
+// Deletes all tokens for a specific user and scope, except for those in the given family.
+// This is the counterpart to DeleteAllForUserExcept() for sessions using refresh tokens.
+func (m TokenModel) DeleteAllForUserExceptFamily(ctx context.Context, scope string, userID int64, keepFamily string) error {
+	query := `
+        DELETE FROM tokens
+        WHERE scope = $1 AND user_id = $2 AND family IS DISTINCT FROM $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, scope, userID, keepFamily)
+	return contextError(ctx, err)
+}
+
+// Returns the sessions of a user, most recently used first. These are the unexpired
+// authentication tokens, and the refresh tokens which haven't been used yet, of which
+// there's one for every session in jwt auth mode.
+func (m TokenModel) GetSessionsForUser(ctx context.Context, userID int64) ([]*Session, error) {
+	query := `
+        SELECT id, hash, COALESCE(family, ''), created_at, last_used_at, expiry, ip, user_agent
+        FROM tokens
+        WHERE user_id = $1 AND expiry > NOW() AND (scope = $2 OR (scope = $3 AND used_at IS NULL))
+        ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, _ := m.DB.Query(ctx, query, userID, ScopeAuthentication, ScopeRefresh)
+
+	sessions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*Session, error) {
+		var session Session
+		err := row.Scan(
+			&session.ID,
+			&session.Hash,
+			&session.Family,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+		)
+		return &session, err
+	})
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return sessions, nil
+}
+
+// Deletes a session of a user by its ID, which for a refresh token means its whole
+// family. If the user has no such session, ErrRecordNotFound is returned.
+func (m TokenModel) DeleteSession(ctx context.Context, id, userID int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $2 AND (
+            (id = $1 AND scope = $3)
+            OR family = (SELECT family FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $4 AND used_at IS NULL)
+        )`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, id, userID, ScopeAuthentication, ScopeRefresh)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Record that a token has been used. As with API keys, last_used_at is only updated once
+// a minute.
+func (m TokenModel) Touch(ctx context.Context, hash []byte) error {
+	query := `
+        UPDATE tokens
+        SET last_used_at = NOW()
+        WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - interval '1 minute')`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.Exec(ctx, query, hash)
+	return contextError(ctx, err)
 }
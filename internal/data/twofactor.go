@@ -0,0 +1,223 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Number of recovery codes generated when two-factor authentication is enabled.
+const recoveryCodeCount = 10
+
+// TwoFactor holds the TOTP secret of a user. It only protects logins once Enabled has
+// been set, after the user proved they set up their authenticator app correctly.
+type TwoFactor struct {
+	UserID   int64
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+// GenerateRecoveryCodes returns a set of new single-use recovery codes in the form
+// "abcde-fghij", along with their hashes for storage.
+func GenerateRecoveryCodes() ([]string, [][]byte, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(randomBytes)[:10])
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = RecoveryCodeHash(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// RecoveryCodeHash returns the SHA-256 hash of a recovery code, ignoring case, spaces and
+// hyphens so that users don't have to type it exactly as shown.
+func RecoveryCodeHash(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// A TwoFactorModel struct type which wraps a connection pool.
+type TwoFactorModel struct {
+	DB *pgxpool.Pool
+}
+
+// Get returns the two-factor settings of a user, or ErrRecordNotFound if they have never
+// started enrolling.
+func (m TwoFactorModel) Get(ctx context.Context, userID int64) (*TwoFactor, error) {
+	query := `
+        SELECT user_id, secret, enabled, last_step
+        FROM two_factor
+        WHERE user_id = $1`
+
+	var twoFactor TwoFactor
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, userID).Scan(&twoFactor.UserID, &twoFactor.Secret, &twoFactor.Enabled, &twoFactor.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &twoFactor, nil
+}
+
+// SetPending stores a new secret for a user who hasn't enabled two-factor authentication
+// yet, replacing the secret of an earlier unfinished enrollment. If two-factor
+// authentication is already enabled, ErrEditConflict is returned.
+func (m TwoFactorModel) SetPending(ctx context.Context, userID int64, secret string) error {
+	query := `
+        INSERT INTO two_factor (user_id, secret)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret = EXCLUDED.secret, last_step = 0, created_at = NOW()
+        WHERE two_factor.enabled = false`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, secret)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Enable turns on two-factor authentication for a user whose secret is pending, marking
+// step as used and replacing any recovery codes with the given hashes. If there's no
+// pending secret, ErrRecordNotFound is returned.
+func (m TwoFactorModel) Enable(ctx context.Context, userID, step int64, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback(ctx)
+
+	result, err := tx.Exec(ctx, `
+        UPDATE two_factor
+        SET enabled = true, last_step = $2
+        WHERE user_id = $1 AND enabled = false`, userID, step)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	_, err = tx.Exec(ctx, `
+        INSERT INTO recovery_codes (user_id, hash)
+        SELECT $1, unnest($2::bytea[])`, userID, recoveryCodeHashes)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit(ctx))
+}
+
+// UseStep records that the code of a TOTP time step has been used. If a code of the same
+// or a later step has been used already, ErrRecordNotFound is returned, so that codes
+// can't be replayed.
+func (m TwoFactorModel) UseStep(ctx context.Context, userID, step int64) error {
+	query := `
+        UPDATE two_factor
+        SET last_step = $2
+        WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, step)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// UseRecoveryCode consumes a recovery code of a user. If the user has no such (unused)
+// code, ErrRecordNotFound is returned.
+func (m TwoFactorModel) UseRecoveryCode(ctx context.Context, userID int64, hash []byte) error {
+	query := `
+        DELETE FROM recovery_codes
+        WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.Exec(ctx, query, userID, hash)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Delete turns off two-factor authentication for a user, removing the secret and all
+// recovery codes.
+func (m TwoFactorModel) Delete(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM two_factor WHERE user_id = $1`, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	return contextError(ctx, tx.Commit(ctx))
+}
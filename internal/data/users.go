@@ -4,13 +4,14 @@ import (
 	"context"
 	"crypto/sha256"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/igredk/greenlight/internal/validator"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var AnonymousUser = &User{}
@@ -20,9 +21,21 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 	Name      string    `json:"name"`
 	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	// Address the user asked to change their email to, which becomes Email once the
+	// change has been confirmed with a token sent to it.
+	PendingEmail string   `json:"pending_email,omitempty"`
+	Password     password `json:"-"`
+	Activated    bool     `json:"activated"`
+	// Suspended users can't log in, and their tokens are deleted when they are suspended.
+	Suspended bool `json:"suspended"`
+	Version   int  `json:"-"`
+}
+
+// A UserStatus tells whether a user is activated and whether they are suspended, which
+// is all there is to know about a user to authenticate a request with an access token.
+type UserStatus struct {
+	Activated bool
+	Suspended bool
 }
 
 // Check if a User instance is the AnonymousUser.
@@ -37,10 +50,10 @@ type password struct {
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
+// The Set() method hashes a plaintext password with the current algorithm (see
+// SetPasswordParams), and stores both the hash and the plaintext versions in the struct.
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := hashPassword(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -54,17 +67,31 @@ func (p *password) Set(plaintextPassword string) error {
 // The Matches() method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false otherwise.
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	return comparePassword(p.hash, plaintextPassword)
+}
+
+// The NeedsRehash() method reports if the hash was made with another algorithm or other
+// parameters than new hashes are, in which case it should be replaced by calling Set()
+// with the plaintext password, the next time it is known.
+func (p *password) NeedsRehash() bool {
+	return passwordNeedsRehash(p.hash)
+}
+
+// Hash compared against when there is no user for an email address, so that failed logins
+// take the same time whether or not the address is registered. It's created on first use,
+// after the password parameters have been set.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := hashPassword("dummy password")
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		panic(err)
 	}
+	return hash
+})
 
-	return true, nil
+// SimulatePasswordCheck does the same work as Matches() for a user who doesn't exist.
+func SimulatePasswordCheck(plaintextPassword string) {
+	p := password{hash: dummyPasswordHash()}
+	p.Matches(plaintextPassword)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -75,7 +102,7 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= MaxPasswordLength(), "password", fmt.Sprintf("must not be more than %d bytes long", MaxPasswordLength()))
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -86,6 +113,9 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		if v.Valid() {
+			ValidatePasswordPolicy(v, *user.Password.plaintext, user)
+		}
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our
@@ -102,7 +132,7 @@ type UserModel struct {
 }
 
 // Insert a new user in the database. ID, created_at and version fields are automatically generated by the database.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
         INSERT INTO users (name, email, password_hash, activated) 
         VALUES ($1, $2, $3, $4)
@@ -110,7 +140,7 @@ func (m UserModel) Insert(user *User) error {
 
 	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
@@ -122,23 +152,279 @@ func (m UserModel) Insert(user *User) error {
 				return ErrDuplicateEmail
 			}
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
 
 	return nil
 }
 
+// Insert a new user and assign them the role with the given name in one transaction, so
+// that a user is never left without a role. If there is no such role, ErrRecordNotFound
+// is returned and the user isn't created either.
+func (m UserModel) InsertWithRole(ctx context.Context, user *User, roleName string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.Begin(ctx)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+        INSERT INTO users (name, email, password_hash, activated)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, version`
+
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+
+	err = tx.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) && pgError.Code == UniqueConstraintViolation {
+			return ErrDuplicateEmail
+		}
+		return contextError(ctx, err)
+	}
+
+	result, err := tx.Exec(ctx, `
+        INSERT INTO users_roles (user_id, role_id)
+        SELECT $1, roles.id FROM roles WHERE roles.name = $2`, user.ID, roleName)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrRecordNotFound
+	}
+
+	return contextError(ctx, tx.Commit(ctx))
+}
+
+// Return the value of the given sort column for the user, together with its id.
+func (user *User) cursorKey(column string) *cursorKey {
+	var value any
+	switch column {
+	case "name":
+		value = user.Name
+	case "email":
+		value = user.Email
+	default:
+		value = user.ID
+	}
+
+	return &cursorKey{value: value, id: user.ID}
+}
+
+// Check that a decoded cursor value has the type of the sort column it is compared with.
+func validUserCursor(column string, c cursor) bool {
+	switch c.Value.(type) {
+	case string:
+		return column == "name" || column == "email"
+	case int64:
+		return column == "id"
+	default:
+		return false
+	}
+}
+
+// Return the keys of the first and last users in a page (nil for an empty page).
+func userCursorKeys(users []*User, column string) (first, last *cursorKey) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	return users[0].cursorKey(column), users[len(users)-1].cursorKey(column)
+}
+
+// Return the users matching the filters, for administrators. The email and name filters
+// match users whose email address or name contains the given text, ignoring case, and
+// activated is ignored if it is nil.
+func (m UserModel) GetAll(ctx context.Context, email, name string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	if filters.Cursor != "" {
+		return m.getAllFromCursor(ctx, email, name, activated, filters)
+	}
+
+	query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, name, email, pending_email, password_hash, activated, suspended, version
+        FROM users
+        WHERE (strpos(lower(email::text), lower($1)) > 0 OR $1 = '')
+        AND (strpos(lower(name), lower($2)) > 0 OR $2 = '')
+        AND (activated = $3 OR $3 IS NULL)
+        ORDER BY %s %s, id ASC
+        LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []any{email, name, activated, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.PendingEmail,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Suspended,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	first, last := userCursorKeys(users, filters.sortColumn())
+	metadata.addCursors(filters, first, last)
+
+	return users, metadata, nil
+}
+
+// Keyset pagination variant of GetAll(), see MovieModel.getAllFromCursor().
+func (m UserModel) getAllFromCursor(ctx context.Context, email, name string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	c, err := filters.decodeCursor()
+	if err != nil || !validUserCursor(filters.sortColumn(), c) {
+		return nil, Metadata{}, ErrInvalidCursor
+	}
+
+	where, orderBy := filters.keysetClauses(c, "$4", "$5")
+
+	query := fmt.Sprintf(`
+        SELECT id, created_at, name, email, pending_email, password_hash, activated, suspended, version
+        FROM users
+        WHERE (strpos(lower(email::text), lower($1)) > 0 OR $1 = '')
+        AND (strpos(lower(name), lower($2)) > 0 OR $2 = '')
+        AND (activated = $3 OR $3 IS NULL)
+        AND %s
+        ORDER BY %s
+        LIMIT $6`, where, orderBy)
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []any{email, name, activated, c.Value, c.ID, filters.limit() + 1}
+
+	rows, _ := m.DB.Query(ctx, query, args...)
+
+	users, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*User, error) {
+		var user User
+		err := row.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.PendingEmail,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Suspended,
+			&user.Version,
+		)
+		return &user, err
+	})
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	users, hasMore := trimKeysetPage(users, filters.limit(), c.Before)
+	first, last := userCursorKeys(users, filters.sortColumn())
+
+	return users, keysetMetadata(filters, c, first, last, hasMore), nil
+}
+
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT id, created_at, name, email, pending_email, password_hash, activated, suspended, version
+        FROM users
+        WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.PendingEmail,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Suspended,
+		&user.Version,
+	)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		} else {
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &user, nil
+}
+
+// Retrieve the status of the user with the given ID.
+func (m UserModel) GetStatus(ctx context.Context, id int64) (*UserStatus, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT activated, suspended
+        FROM users
+        WHERE id = $1`
+
+	var status UserStatus
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRow(ctx, query, id).Scan(&status.Activated, &status.Suspended)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, contextError(ctx, err)
+	}
+
+	return &status, nil
+}
+
 // Retrieve the User details from the database based on the user's email address.
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-        SELECT id, created_at, name, email, password_hash, activated, version
+        SELECT id, created_at, name, email, pending_email, password_hash, activated, suspended, version
         FROM users
         WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, email).Scan(
@@ -146,15 +432,17 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Suspended,
 		&user.Version,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, ErrRecordNotFound
 		} else {
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
@@ -162,23 +450,25 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 // Update the details for a specific user.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
         UPDATE users 
-        SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-        WHERE id = $5 AND version = $6
+        SET name = $1, email = $2, pending_email = $3, password_hash = $4, activated = $5, suspended = $6, version = version + 1
+        WHERE id = $7 AND version = $8
         RETURNING version`
 
 	args := []any{
 		user.Name,
 		user.Email,
+		user.PendingEmail,
 		user.Password.hash,
 		user.Activated,
+		user.Suspended,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRow(ctx, query, args...).Scan(&user.Version)
@@ -192,20 +482,20 @@ func (m UserModel) Update(user *User) error {
 		case errors.Is(err, pgx.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
 
 	return nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// This returns a byte array with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-        SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.activated, u.version
+        SELECT u.id, u.created_at, u.name, u.email, u.pending_email, u.password_hash, u.activated, u.suspended, u.version
         FROM users u
         INNER JOIN tokens t ON u.id = t.user_id
         WHERE t.hash = $1 AND t.scope = $2 AND t.expiry > $3`
@@ -217,7 +507,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no matching
@@ -227,8 +517,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
+		&user.PendingEmail,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Suspended,
 		&user.Version,
 	)
 	if err != nil {
@@ -236,7 +528,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		case errors.Is(err, pgx.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
@@ -0,0 +1,188 @@
+// Package jwt signs and verifies JSON Web Tokens (RFC 7519). Only the compact serialization
+// is supported, with HS256 for the API's own access tokens and RS256 for ID tokens from
+// OpenID Connect providers.
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for tokens which are malformed, use another algorithm
+	// or have a bad signature.
+	ErrInvalidToken = errors.New("jwt: invalid token")
+	// ErrExpired is returned by Claims.Validate for tokens which have expired.
+	ErrExpired = errors.New("jwt: token expired")
+)
+
+// The header is the same for every token we sign.
+var header = encode([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims are the registered claims used by the API. Embed them in a struct to add
+// private claims.
+type Claims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Validate checks that the token was issued by issuer and hasn't expired at t.
+func (c Claims) Validate(issuer string, t time.Time) error {
+	if c.Issuer != issuer {
+		return ErrInvalidToken
+	}
+	if t.Unix() >= c.ExpiresAt {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// Sign encodes claims as JSON and returns the signed token.
+func Sign(claims any, key []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + encode(payload)
+
+	return unsigned + "." + encode(sign(unsigned, key)), nil
+}
+
+// Parse verifies the signature of a token and decodes its claims into the value pointed
+// to by claims. It doesn't check the claims themselves; see Claims.Validate for that.
+func Parse(token string, key []byte, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	// Rather than decoding the header, require the exact one we sign with. This rules out
+	// "alg":"none" and algorithm confusion attacks.
+	if parts[0] != header {
+		return ErrInvalidToken
+	}
+
+	signature, err := decode(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if !hmac.Equal(signature, sign(parts[0]+"."+parts[1], key)) {
+		return ErrInvalidToken
+	}
+
+	payload, err := decode(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// SignRS256 encodes claims as JSON and returns the token signed with RSASSA-PKCS1-v1_5 and
+// SHA-256. kid identifies the key, so that verifiers can pick it from a key set.
+func SignRS256(claims any, key *rsa.PrivateKey, kid string) (string, error) {
+	header, err := json.Marshal(Header{Algorithm: "RS256", Type: "JWT", KeyID: kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + encode(signature), nil
+}
+
+// ParseRS256 verifies the signature of a token signed with RS256 and decodes its claims
+// into the value pointed to by claims. keyFunc returns the public key for the key ID in
+// the header. Tokens using any other algorithm are rejected.
+func ParseRS256(token string, keyFunc func(kid string) (*rsa.PublicKey, error), claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	rawHeader, err := decode(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var header Header
+	if err := json.Unmarshal(rawHeader, &header); err != nil || header.Algorithm != "RS256" {
+		return ErrInvalidToken
+	}
+
+	key, err := keyFunc(header.KeyID)
+	if err != nil {
+		return err
+	}
+
+	signature, err := decode(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return ErrInvalidToken
+	}
+
+	payload, err := decode(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// LooksLikeToken reports if s has the shape of a compact JWT, so that it can be told
+// apart from other kinds of bearer tokens without verifying it.
+func LooksLikeToken(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+func sign(unsigned string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
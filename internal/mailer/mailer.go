@@ -4,9 +4,6 @@ import (
 	"bytes"
 	"embed"
 	"html/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
 )
 
 // Below we declare a new variable with the type embed.FS (embedded file system) to hold email templates.
@@ -16,23 +13,18 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// Define a Mailer struct which contains a mail.Dialer instance (used to connect to a
-// SMTP server) and the sender information for emails (the name and address you
-// want the email to be from, such as "Alice Smith <alice@example.com>").
+// Define a Mailer struct which contains the Transport used to deliver emails and the
+// sender information for emails (the name and address you want the email to be from,
+// such as "Alice Smith <alice@example.com>").
 type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+	transport Transport
+	sender    string
 }
 
-func New(host string, port int, username, password, sender string) Mailer {
-	// Initialize a new mail.Dialer instance with the given SMTP server settings.
-	// Also configure this to use a 5-second timeout whenever we send an email.
-	dialer := mail.NewDialer(host, port, username, password)
-	dialer.Timeout = 5 * time.Second
-
+func New(transport Transport, sender string) Mailer {
 	return Mailer{
-		dialer: dialer,
-		sender: sender,
+		transport: transport,
+		sender:    sender,
 	}
 }
 
@@ -63,24 +55,14 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 	if err != nil {
 		return err
 	}
-	// Use the mail.NewMessage() function to initialize a new mail.Message instance.
-	// Then we use the SetHeader() method to set the email recipient, sender and subject
-	// headers, the SetBody() method to set the plain-text body, and the AddAlternative()
-	// method to set the HTML body. AddAlternative() should always be called *after* SetBody().
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	// Call the DialAndSend() method on the dialer, passing in the message to send. This
-	// opens a connection to the SMTP server, sends the message, then closes the
-	// connection. If there is a timeout, it will return a "dial tcp: i/o timeout" error.
-	err = m.dialer.DialAndSend(msg)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Hand the rendered message to the transport, which sends it over SMTP, writes it
+	// to a file, etc.
+	return m.transport.Deliver(&Message{
+		To:        recipient,
+		From:      m.sender,
+		Template:  templateFile,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	})
 }
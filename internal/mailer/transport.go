@@ -0,0 +1,155 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-mail/mail/v2"
+	"github.com/igredk/greenlight/internal/jsonlog"
+)
+
+// A Message is an email which has been rendered from its template.
+type Message struct {
+	To        string
+	From      string
+	Template  string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+}
+
+// Build the MIME message with the plain-text body and the HTML body as an alternative.
+func (m *Message) mime() *mail.Message {
+	msg := mail.NewMessage()
+	msg.SetHeader("To", m.To)
+	msg.SetHeader("From", m.From)
+	msg.SetHeader("Subject", m.Subject)
+	msg.SetBody("text/plain", m.PlainBody)
+	// AddAlternative() should always be called *after* SetBody().
+	msg.AddAlternative("text/html", m.HTMLBody)
+	return msg
+}
+
+// A Transport delivers rendered messages.
+type Transport interface {
+	Deliver(msg *Message) error
+}
+
+// SMTPTransport delivers messages through an SMTP server.
+type SMTPTransport struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPTransport(host string, port int, username, password string) *SMTPTransport {
+	// Use a 5-second timeout whenever we send an email.
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPTransport{dialer: dialer}
+}
+
+// Deliver opens a connection to the SMTP server, sends the message, then closes the
+// connection. If there is a timeout, it returns a "dial tcp: i/o timeout" error.
+func (t *SMTPTransport) Deliver(msg *Message) error {
+	return t.dialer.DialAndSend(msg.mime())
+}
+
+// FileTransport writes every message to a .eml file in a directory, where it can be
+// opened with any mail client.
+type FileTransport struct {
+	dir string
+}
+
+// NewFileTransport creates the directory if it doesn't exist yet.
+func NewFileTransport(dir string) (*FileTransport, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileTransport{dir: dir}, nil
+}
+
+func (t *FileTransport) Deliver(msg *Message) error {
+	// Prefix the name with the time so that the files sort in the order they were sent.
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000"), hex.EncodeToString(suffix))
+
+	f, err := os.Create(filepath.Join(t.dir, name))
+	if err != nil {
+		return err
+	}
+
+	_, err = msg.mime().WriteTo(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LogTransport logs the recipient and template of messages instead of sending them,
+// which is handy in development to see which emails would go out. Bodies are left out,
+// since they contain tokens which must not end up in the log; use FileTransport to read
+// them.
+type LogTransport struct {
+	logger *jsonlog.Logger
+}
+
+func NewLogTransport(logger *jsonlog.Logger) *LogTransport {
+	return &LogTransport{logger: logger}
+}
+
+func (t *LogTransport) Deliver(msg *Message) error {
+	t.logger.PrintInfo("email", map[string]string{
+		"to":       msg.To,
+		"template": msg.Template,
+	})
+	return nil
+}
+
+// MemoryTransport keeps messages in memory, so that tests can inspect what was sent. It
+// isn't offered by the -mailer flag, as nothing would ever read the messages.
+type MemoryTransport struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+func (t *MemoryTransport) Deliver(msg *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = append(t.messages, *msg)
+	return nil
+}
+
+// Messages returns the messages delivered so far, oldest first.
+func (t *MemoryTransport) Messages() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return slices.Clone(t.messages)
+}
+
+// Reset discards all messages delivered so far.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.messages = nil
+}
@@ -0,0 +1,310 @@
+// Package migrate applies the SQL migrations from the migrations directory. Files follow
+// the naming scheme of the migrate CLI ("000001_create_movies_table.up.sql") so both
+// tools can be used with the same directory.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Arbitrary key for the PostgreSQL advisory lock which serializes migration runs, so
+// that two replicas starting at the same time can't apply the same migration twice.
+const lockKey = 7_265_931_004
+
+var (
+	ErrNoChange       = errors.New("no change")
+	ErrUnknownVersion = errors.New("unknown migration version")
+
+	fileRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+)
+
+// A Migration holds the up and down SQL for a single version.
+type Migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string
+}
+
+// The Status of a migration: if it has been applied, and when.
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []*Migration // sorted by version
+}
+
+// New reads all migration files from the root of fsys.
+func New(pool *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		matches := fileRX.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = migration
+		}
+
+		if matches[3] == "up" {
+			migration.up = string(content)
+		} else {
+			migration.down = string(content)
+		}
+	}
+
+	m := &Migrator{pool: pool}
+	for _, migration := range byVersion {
+		m.migrations = append(m.migrations, migration)
+	}
+	slices.SortFunc(m.migrations, func(a, b *Migration) int {
+		return int(a.Version - b.Version)
+	})
+
+	return m, nil
+}
+
+// Up applies all pending migrations. It returns ErrNoChange if there were none.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn, applied map[int64]time.Time) error {
+		changed := false
+
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if err := m.apply(ctx, conn, migration, true); err != nil {
+				return err
+			}
+			changed = true
+		}
+
+		if !changed {
+			return ErrNoChange
+		}
+		return nil
+	})
+}
+
+// Down reverts the most recently applied migration. It returns ErrNoChange if no
+// migrations have been applied.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.withLock(ctx, func(conn *pgxpool.Conn, applied map[int64]time.Time) error {
+		for _, migration := range slices.Backward(m.migrations) {
+			if _, ok := applied[migration.Version]; ok {
+				return m.apply(ctx, conn, migration, false)
+			}
+		}
+
+		return ErrNoChange
+	})
+}
+
+// Goto migrates up or down until exactly the migrations up to and including version are
+// applied. A version of 0 reverts all migrations.
+func (m *Migrator) Goto(ctx context.Context, version int64) error {
+	known := version == 0 || slices.ContainsFunc(m.migrations, func(migration *Migration) bool {
+		return migration.Version == version
+	})
+	if !known {
+		return ErrUnknownVersion
+	}
+
+	return m.withLock(ctx, func(conn *pgxpool.Conn, applied map[int64]time.Time) error {
+		changed := false
+		// Revert newer migrations first, newest to oldest...
+		for _, migration := range slices.Backward(m.migrations) {
+			if _, ok := applied[migration.Version]; ok && migration.Version > version {
+				if err := m.apply(ctx, conn, migration, false); err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+		// ...then apply any missing ones up to the target version, oldest to newest.
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; !ok && migration.Version <= version {
+				if err := m.apply(ctx, conn, migration, true); err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+
+		if !changed {
+			return ErrNoChange
+		}
+		return nil
+	})
+}
+
+// Status returns the status of every known migration, ordered by version.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	statuses := []Status{}
+
+	err := m.withLock(ctx, func(conn *pgxpool.Conn, applied map[int64]time.Time) error {
+		for _, migration := range m.migrations {
+			appliedAt, ok := applied[migration.Version]
+			statuses = append(statuses, Status{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				Applied:   ok,
+				AppliedAt: appliedAt,
+			})
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+// Acquire a connection, take the advisory lock on it and make sure the schema_versions
+// table exists, then call fn with the currently applied versions. The lock is
+// session-level, so everything must run on the same connection.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn, applied map[int64]time.Time) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		return err
+	}
+	// Use a fresh context for the unlock, so that the lock is released even if ctx has
+	// been canceled in the meantime.
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	_, err = conn.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_versions (
+            version bigint PRIMARY KEY,
+            name text NOT NULL,
+            applied_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+        )`)
+	if err != nil {
+		return err
+	}
+
+	if err := m.adoptMigrateCLIVersion(ctx, conn); err != nil {
+		return err
+	}
+
+	rows, _ := conn.Query(ctx, `SELECT version, applied_at FROM schema_versions`)
+	applied := make(map[int64]time.Time)
+	var (
+		version   int64
+		appliedAt time.Time
+	)
+	_, err = pgx.ForEachRow(rows, []any{&version, &appliedAt}, func() error {
+		applied[version] = appliedAt
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return fn(conn, applied)
+}
+
+// Databases which were migrated with the migrate CLI record their current version in the
+// schema_migrations table instead. If schema_versions is still empty, mark every
+// migration up to that version as applied so that they aren't run a second time.
+func (m *Migrator) adoptMigrateCLIVersion(ctx context.Context, conn *pgxpool.Conn) error {
+	var exists bool
+	err := conn.QueryRow(ctx, `
+        SELECT to_regclass('schema_migrations') IS NOT NULL
+        AND NOT EXISTS (SELECT 1 FROM schema_versions)`).Scan(&exists)
+	if err != nil || !exists {
+		return err
+	}
+
+	var (
+		version int64
+		dirty   bool
+	)
+	err = conn.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("schema_migrations is dirty at version %d, fix it before migrating", version)
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version > version {
+			break
+		}
+		_, err = conn.Exec(ctx, `INSERT INTO schema_versions (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run the up or down SQL of a single migration, and record the change in the
+// schema_versions table within the same transaction.
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, migration *Migration, up bool) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op if the transaction has already been committed.
+	defer tx.Rollback(ctx)
+
+	if up {
+		_, err = tx.Exec(ctx, migration.up)
+		if err == nil {
+			_, err = tx.Exec(ctx, `INSERT INTO schema_versions (version, name) VALUES ($1, $2)`, migration.Version, migration.Name)
+		}
+	} else {
+		_, err = tx.Exec(ctx, migration.down)
+		if err == nil {
+			_, err = tx.Exec(ctx, `DELETE FROM schema_versions WHERE version = $1`, migration.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,31 @@
+-- Announce changes to the permissions of users on the permissions_changed channel, so
+-- that every API replica can invalidate its permission cache. The payload is the ID of
+-- the affected user, or empty if the permissions of a whole role changed.
+CREATE OR REPLACE FUNCTION notify_permissions_changed() RETURNS trigger AS $$
+BEGIN
+    IF TG_TABLE_NAME = 'roles_permissions' THEN
+        PERFORM pg_notify('permissions_changed', '');
+        RETURN NULL;
+    END IF;
+
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM pg_notify('permissions_changed', OLD.user_id::text);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM pg_notify('permissions_changed', NEW.user_id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_permissions_notify
+AFTER INSERT OR UPDATE OR DELETE ON users_permissions
+FOR EACH ROW EXECUTE FUNCTION notify_permissions_changed();
+
+CREATE TRIGGER users_roles_notify
+AFTER INSERT OR UPDATE OR DELETE ON users_roles
+FOR EACH ROW EXECUTE FUNCTION notify_permissions_changed();
+
+CREATE TRIGGER roles_permissions_notify
+AFTER INSERT OR UPDATE OR DELETE ON roles_permissions
+FOR EACH ROW EXECUTE FUNCTION notify_permissions_changed();
@@ -0,0 +1,8 @@
+-- Failed logins are tracked per email address rather than per user, so that addresses
+-- without an account behave exactly like those with one.
+CREATE TABLE IF NOT EXISTS login_attempts (
+    email citext PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp(0) with time zone
+);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS two_factor (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    secret text NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    -- The TOTP time step of the last code used, so that no code can be used twice.
+    last_step bigint NOT NULL DEFAULT 0,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    hash bytea NOT NULL,
+    PRIMARY KEY (user_id, hash)
+);
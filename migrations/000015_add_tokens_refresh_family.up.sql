@@ -0,0 +1,7 @@
+-- Refresh tokens are rotated on every use. All tokens descending from the same login
+-- share a family, and used ones are kept until they expire, so that a stolen refresh
+-- token being used a second time can be detected and the whole family revoked.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family text;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS tokens_family_idx ON tokens (family) WHERE family IS NOT NULL;
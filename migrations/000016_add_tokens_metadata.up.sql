@@ -0,0 +1,9 @@
+-- Sessions are listed and revoked by ID, so that token hashes never leave the server.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS id bigserial;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS ip text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX IF NOT EXISTS tokens_id_idx ON tokens (id);
+CREATE INDEX IF NOT EXISTS tokens_user_id_scope_idx ON tokens (user_id, scope);
@@ -0,0 +1,10 @@
+-- Pending OpenID Connect logins, keyed by a hash of the state parameter. A row is
+-- deleted when the provider redirects back, so every state can only be used once.
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash bytea PRIMARY KEY,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oidc_logins_expiry_idx ON oidc_logins (expiry);
@@ -0,0 +1 @@
+-- The scrubbed template data can't be restored.
@@ -0,0 +1 @@
+UPDATE email_outbox SET data = '{}' WHERE status IN ('sent', 'dead') AND data <> '{}';
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS users_status_notify ON users;
+DROP FUNCTION IF EXISTS notify_user_status_changed();
@@ -0,0 +1,15 @@
+-- Announce on the user_status_changed channel when a user is activated, deactivated,
+-- suspended or has their suspension lifted, so that every API replica can invalidate
+-- its status cache. The payload is the ID of the user.
+CREATE OR REPLACE FUNCTION notify_user_status_changed() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('user_status_changed', NEW.id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_status_notify
+AFTER UPDATE OF activated, suspended ON users
+FOR EACH ROW
+WHEN (OLD.activated IS DISTINCT FROM NEW.activated OR OLD.suspended IS DISTINCT FROM NEW.suspended)
+EXECUTE FUNCTION notify_user_status_changed();
@@ -0,0 +1,8 @@
+// Package migrations embeds the SQL migration files, so that the API binary can apply
+// them without the external migrate tool.
+package migrations
+
+import "embed"
+
+//go:embed "*.sql"
+var FS embed.FS